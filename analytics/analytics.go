@@ -0,0 +1,205 @@
+// Package analytics records what people search for and which results they
+// pick in a local bolt database.
+package analytics
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	searchesBucket = []byte("searches")
+	clicksBucket   = []byte("clicks")
+)
+
+// Search is a single search.
+type Search struct {
+	Time    time.Time `json:"time"`
+	Query   string    `json:"query"`
+	Type    string    `json:"type,omitempty"`
+	Results uint64    `json:"results"`
+}
+
+// Click is an item looked up after a search.
+type Click struct {
+	Time time.Time `json:"time"`
+	Id   string    `json:"id"`
+}
+
+// Count is how many times a query was searched for or an item was clicked.
+type Count struct {
+	Term  string `json:"term"`
+	Count int    `json:"count"`
+}
+
+// Stats summarizes the recorded searches and clicks.
+type Stats struct {
+	Searches    int      `json:"searches"`
+	Clicks      int      `json:"clicks"`
+	TopQueries  []*Count `json:"top_queries"`
+	ZeroResults []*Count `json:"zero_results"`
+	TopClicks   []*Count `json:"top_clicks"`
+}
+
+// Recorder records searches and clicks.
+type Recorder struct {
+	db *bolt.DB
+
+	mu      sync.Mutex
+	closed  bool
+	pending sync.WaitGroup
+}
+
+// Open opens or creates the analytics database at path.
+func Open(path string) (*Recorder, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{searchesBucket, clicksBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Recorder{db: db}, nil
+}
+
+// Background calls fn in the background, logging its error, so recording
+// doesn't slow down requests. Nothing is recorded once the recorder is closed.
+func (r *Recorder) Background(fn func(*Recorder) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.pending.Add(1)
+	go func() {
+		defer r.pending.Done()
+		if err := fn(r); err != nil {
+			log.Printf("Failed to record analytics: %s", err)
+		}
+	}()
+}
+
+// Close waits for the events being recorded in the background and closes the
+// database.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.pending.Wait()
+	return r.db.Close()
+}
+
+// append stores the event as JSON under the next key of the bucket.
+func (r *Recorder) append(bucket []byte, event interface{}) error {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return r.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, buf)
+	})
+}
+
+// Search records a search for query with the type filter and how many results
+// it had.
+func (r *Recorder) Search(query, typ string, results uint64) error {
+	return r.append(searchesBucket, &Search{
+		Time:    time.Now(),
+		Query:   query,
+		Type:    typ,
+		Results: results,
+	})
+}
+
+// Click records that the item with the id was looked up.
+func (r *Recorder) Click(id string) error {
+	return r.append(clicksBucket, &Click{
+		Time: time.Now(),
+		Id:   id,
+	})
+}
+
+// normalize groups queries that only differ by case and spacing.
+func normalize(query string) string {
+	return strings.Join(strings.Fields(strings.ToLower(query)), " ")
+}
+
+// top returns the n most frequent terms, most frequent first.
+func top(counts map[string]int, n int) []*Count {
+	sorted := []*Count{}
+	for term, count := range counts {
+		sorted = append(sorted, &Count{Term: term, Count: count})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Term < sorted[j].Term
+	})
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+// Stats returns the n top queries, zero result queries and clicked items.
+func (r *Recorder) Stats(n int) (*Stats, error) {
+	stats := &Stats{}
+	queries := make(map[string]int)
+	zero := make(map[string]int)
+	clicks := make(map[string]int)
+	if err := r.db.View(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(searchesBucket).ForEach(func(k, v []byte) error {
+			var s Search
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			stats.Searches++
+			query := normalize(s.Query)
+			queries[query]++
+			if s.Results == 0 {
+				zero[query]++
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		return tx.Bucket(clicksBucket).ForEach(func(k, v []byte) error {
+			var c Click
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			stats.Clicks++
+			clicks[c.Id]++
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	stats.TopQueries = top(queries, n)
+	stats.ZeroResults = top(zero, n)
+	stats.TopClicks = top(clicks, n)
+	return stats, nil
+}
@@ -0,0 +1,53 @@
+package analytics
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCloseWaitsForBackground(t *testing.T) {
+	dir, err := ioutil.TempDir("", "analytics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "analytics.db")
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 50
+	for i := 0; i < n; i++ {
+		r.Background(func(r *Recorder) error {
+			return r.Search("Restroom", "", 0)
+		})
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Events after closing are dropped rather than written to a closed
+	// database.
+	r.Background(func(r *Recorder) error {
+		t.Error("recorded after closing")
+		return nil
+	})
+
+	r, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stats, err := r.Stats(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Searches != n {
+		t.Errorf("got %d searches, want %d", stats.Searches, n)
+	}
+	if len(stats.ZeroResults) != 1 || stats.ZeroResults[0].Term != "restroom" || stats.ZeroResults[0].Count != n {
+		t.Errorf("got zero result queries %+v, want restroom %d times", stats.ZeroResults, n)
+	}
+}
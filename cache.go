@@ -6,10 +6,10 @@ import (
 )
 
 func (s *Server) initCache() {
-	s.zoomedFloorCache = groupcache.GetGroup("zoomedImages")
-	if s.zoomedFloorCache == nil {
-		g := zoomedImageGetter{s}
-		s.zoomedFloorCache = groupcache.NewGroup("zoomedImages", int64(256*units.MiB), g)
+	s.floorTileCache = groupcache.GetGroup("floorTiles")
+	if s.floorTileCache == nil {
+		g := floorTileGetter{s}
+		s.floorTileCache = groupcache.NewGroup("floorTiles", int64(256*units.MiB), g)
 	}
 
 }
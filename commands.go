@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/d4l3k/campus/geojson"
+	"github.com/d4l3k/campus/imdf"
+	"github.com/d4l3k/campus/models"
+)
+
+// commands are run instead of the server when named as the first argument,
+// e.g. `campus geojson -sis ICCS`.
+var commands = map[string]func(args []string) error{
+	"geojson":   geojsonCommand,
+	"imdf":      imdfCommand,
+	"prerender": prerenderCommand,
+}
+
+// geojsonCommand writes the map data as a GeoJSON FeatureCollection.
+func geojsonCommand(args []string) error {
+	fs := flag.NewFlagSet("geojson", flag.ExitOnError)
+	sis := fs.String("sis", "", "only export the building with this SIS")
+	floor := fs.String("floor", "", "only export floors with this name")
+	out := fs.String("o", "", "the file to write to; defaults to stdout")
+	fs.Parse(args)
+
+	buildings, err := models.LoadMapData()
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if len(*out) > 0 {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	filter := geojson.Filter{SIS: *sis, Floor: *floor}
+	return json.NewEncoder(w).Encode(geojson.FromBuildings(buildings, filter))
+}
+
+// imdfCommand writes the map data as an IMDF archive.
+func imdfCommand(args []string) error {
+	fs := flag.NewFlagSet("imdf", flag.ExitOnError)
+	out := fs.String("o", "imdf.zip", "the archive to write")
+	fs.Parse(args)
+
+	buildings, err := models.LoadMapData()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return imdf.Write(f, buildings, *venueName)
+}
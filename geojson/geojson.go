@@ -0,0 +1,133 @@
+// Package geojson converts the campus map data to and from GeoJSON.
+package geojson
+
+import (
+	"encoding/json"
+
+	"github.com/d4l3k/campus/models"
+)
+
+// Kinds of features, stored in the "kind" property.
+const (
+	KindBuilding = "building"
+	KindFloor    = "floor"
+	KindRoom     = "room"
+)
+
+type FeatureCollection struct {
+	Type     string     `json:"type"`
+	Features []*Feature `json:"features"`
+}
+
+type Feature struct {
+	Type       string                 `json:"type"`
+	Geometry   *Geometry              `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type Geometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// NewPoint returns a Point geometry.
+func NewPoint(p *models.LatLng) *Geometry {
+	buf, _ := json.Marshal(position(p))
+	return &Geometry{
+		Type:        "Point",
+		Coordinates: buf,
+	}
+}
+
+// NewPolygon returns a Polygon geometry with a single ring. The ring is
+// closed if it isn't already.
+func NewPolygon(ring []*models.LatLng) *Geometry {
+	var coords [][]float64
+	for _, p := range ring {
+		coords = append(coords, position(p))
+	}
+	if len(ring) > 0 && *ring[0] != *ring[len(ring)-1] {
+		coords = append(coords, coords[0])
+	}
+	buf, _ := json.Marshal([][][]float64{coords})
+	return &Geometry{
+		Type:        "Polygon",
+		Coordinates: buf,
+	}
+}
+
+func position(p *models.LatLng) []float64 {
+	return []float64{p.Lng, p.Lat}
+}
+
+// Filter limits an export to a single building and/or floor. Empty fields
+// match everything.
+type Filter struct {
+	SIS   string
+	Floor string
+}
+
+// FromBuildings returns a FeatureCollection with building points, floor
+// footprints and room points. Floors also have their unrotated coords as a
+// property, since they can't be recovered exactly from a georeferenced
+// footprint.
+func FromBuildings(buildings []*models.Building, filter Filter) *FeatureCollection {
+	fc := &FeatureCollection{
+		Type:     "FeatureCollection",
+		Features: []*Feature{},
+	}
+	for _, b := range buildings {
+		if len(filter.SIS) > 0 && b.SIS != filter.SIS {
+			continue
+		}
+		if b.Position != nil {
+			fc.Features = append(fc.Features, &Feature{
+				Type:     "Feature",
+				Geometry: NewPoint(b.Position),
+				Properties: map[string]interface{}{
+					"kind":    KindBuilding,
+					"sis":     b.SIS,
+					"name":    b.Name,
+					"address": b.Address,
+				},
+			})
+		}
+		for _, f := range b.Floors {
+			if len(filter.Floor) > 0 && f.Name != filter.Floor {
+				continue
+			}
+			if f.Coords != nil {
+				fc.Features = append(fc.Features, &Feature{
+					Type:     "Feature",
+					Geometry: NewPolygon(f.Footprint()),
+					Properties: map[string]interface{}{
+						"kind":     KindFloor,
+						"sis":      b.SIS,
+						"floor":    f.Name,
+						"image":    f.Image,
+						"rotation": f.Rotation,
+						"coords":   f.Coords,
+					},
+				})
+			}
+			for _, r := range f.Rooms {
+				if r.Position == nil {
+					continue
+				}
+				fc.Features = append(fc.Features, &Feature{
+					Type:     "Feature",
+					Geometry: NewPoint(r.Position),
+					Properties: map[string]interface{}{
+						"kind":  KindRoom,
+						"sis":   b.SIS,
+						"floor": f.Name,
+						"id":    r.Id,
+						"name":  r.Name,
+						"type":  r.Type,
+					},
+				})
+			}
+		}
+	}
+	return fc
+}
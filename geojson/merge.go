@@ -0,0 +1,247 @@
+package geojson
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/d4l3k/campus/models"
+)
+
+// Change describes a floor or room added or updated by Merge.
+type Change struct {
+	Action string `json:"action"`
+	Kind   string `json:"kind"`
+	SIS    string `json:"sis"`
+	Floor  string `json:"floor"`
+	Id     string `json:"id,omitempty"`
+}
+
+func (c Change) String() string {
+	prefix := "+"
+	if c.Action == "update" {
+		prefix = "~"
+	}
+	name := c.SIS + " floor " + c.Floor
+	if len(c.Id) > 0 {
+		name += " room " + c.Id
+	}
+	return fmt.Sprintf("%s %s %s", prefix, c.Kind, name)
+}
+
+// Point returns the position of a Point geometry.
+func (g Geometry) Point() (*models.LatLng, error) {
+	if g.Type != "Point" {
+		return nil, fmt.Errorf("expected Point geometry, got %q", g.Type)
+	}
+	var coords []float64
+	if err := json.Unmarshal(g.Coordinates, &coords); err != nil {
+		return nil, err
+	}
+	if len(coords) < 2 {
+		return nil, errors.New("point needs two coordinates")
+	}
+	return &models.LatLng{Lat: coords[1], Lng: coords[0]}, nil
+}
+
+// Bounds returns the bounding box of a Polygon geometry.
+func (g Geometry) Bounds() (*models.Coords, error) {
+	if g.Type != "Polygon" {
+		return nil, fmt.Errorf("expected Polygon geometry, got %q", g.Type)
+	}
+	var rings [][][]float64
+	if err := json.Unmarshal(g.Coordinates, &rings); err != nil {
+		return nil, err
+	}
+	if len(rings) == 0 || len(rings[0]) == 0 {
+		return nil, errors.New("polygon has no coordinates")
+	}
+	c := &models.Coords{
+		North: math.Inf(-1),
+		South: math.Inf(1),
+		East:  math.Inf(-1),
+		West:  math.Inf(1),
+	}
+	for _, p := range rings[0] {
+		if len(p) < 2 {
+			return nil, errors.New("polygon position needs two coordinates")
+		}
+		c.West = math.Min(c.West, p[0])
+		c.East = math.Max(c.East, p[0])
+		c.South = math.Min(c.South, p[1])
+		c.North = math.Max(c.North, p[1])
+	}
+	return c, nil
+}
+
+// floorCoords returns the unrotated coords of a floor feature from its
+// "coords" property, falling back to the bounds of its polygon.
+func (f Feature) floorCoords() (*models.Coords, error) {
+	prop, ok := f.Properties["coords"]
+	if !ok || prop == nil {
+		return f.Geometry.Bounds()
+	}
+	buf, err := json.Marshal(prop)
+	if err != nil {
+		return nil, err
+	}
+	c := &models.Coords{}
+	if err := json.Unmarshal(buf, c); err != nil {
+		return nil, fmt.Errorf("invalid coords: %s", err)
+	}
+	if c.North <= c.South || c.East <= c.West {
+		return nil, errors.New("coords must have north above south and east of west")
+	}
+	return c, nil
+}
+
+func (f Feature) property(key string) string {
+	v, _ := f.Properties[key].(string)
+	return v
+}
+
+// Merge adds or updates the floors and rooms described by the features in fc.
+// Floors are polygons and rooms are points, as produced by FromBuildings. A
+// floor's coords come from its "coords" property if it has one, otherwise from
+// the bounds of its polygon.
+// Building features are ignored. Every feature must reference an existing
+// building SIS, and every room an existing or imported floor. Nothing is
+// modified if any feature is invalid or dryRun is set.
+func Merge(buildings []*models.Building, fc *FeatureCollection, dryRun bool) ([]Change, error) {
+	bySIS := make(map[string]*models.Building)
+	for _, b := range buildings {
+		bySIS[b.SIS] = b
+	}
+
+	var errs []string
+	var floors, rooms []*Feature
+	for i, f := range fc.Features {
+		kind := f.property("kind")
+		if kind == KindBuilding {
+			continue
+		}
+		if f.Geometry == nil {
+			errs = append(errs, fmt.Sprintf("feature %d: missing geometry", i))
+			continue
+		}
+		if kind == "" {
+			if f.Geometry.Type == "Polygon" {
+				kind = KindFloor
+			} else {
+				kind = KindRoom
+			}
+		}
+		sis := f.property("sis")
+		if _, ok := bySIS[sis]; !ok {
+			errs = append(errs, fmt.Sprintf("feature %d: unknown building SIS %q", i, sis))
+			continue
+		}
+		if len(f.property("floor")) == 0 {
+			errs = append(errs, fmt.Sprintf("feature %d: missing floor", i))
+			continue
+		}
+		var err error
+		switch kind {
+		case KindFloor:
+			_, err = f.floorCoords()
+			floors = append(floors, f)
+		case KindRoom:
+			if len(f.property("id")) == 0 {
+				err = errors.New("missing room id")
+			} else {
+				_, err = f.Geometry.Point()
+			}
+			rooms = append(rooms, f)
+		default:
+			err = fmt.Errorf("unknown kind %q", kind)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("feature %d: %s", i, err))
+		}
+	}
+
+	imported := make(map[string]bool)
+	for _, f := range floors {
+		imported[f.property("sis")+"/"+f.property("floor")] = true
+	}
+	for _, f := range rooms {
+		sis, floor := f.property("sis"), f.property("floor")
+		if imported[sis+"/"+floor] || findFloor(bySIS[sis], floor) != nil {
+			continue
+		}
+		errs = append(errs, fmt.Sprintf("room %s %s: unknown floor %q", sis, f.property("id"), floor))
+	}
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+
+	var changes []Change
+	for _, f := range floors {
+		b := bySIS[f.property("sis")]
+		c := Change{Action: "add", Kind: KindFloor, SIS: b.SIS, Floor: f.property("floor")}
+		floor := findFloor(b, c.Floor)
+		if floor != nil {
+			c.Action = "update"
+		}
+		changes = append(changes, c)
+		if dryRun {
+			continue
+		}
+		if floor == nil {
+			floor = &models.Floor{Name: c.Floor}
+			b.Floors = append(b.Floors, floor)
+		}
+		floor.Coords, _ = f.floorCoords()
+		if image := f.property("image"); len(image) > 0 {
+			floor.Image = image
+		}
+		if rotation, ok := f.Properties["rotation"].(float64); ok {
+			floor.Rotation = rotation
+		}
+	}
+	for _, f := range rooms {
+		b := bySIS[f.property("sis")]
+		c := Change{Action: "add", Kind: KindRoom, SIS: b.SIS, Floor: f.property("floor"), Id: f.property("id")}
+		floor := findFloor(b, c.Floor)
+		var room *models.Room
+		if floor != nil {
+			for _, r := range floor.Rooms {
+				if r.Id == c.Id {
+					room = r
+					c.Action = "update"
+					break
+				}
+			}
+		}
+		changes = append(changes, c)
+		if dryRun {
+			continue
+		}
+		if room == nil {
+			room = &models.Room{Id: c.Id, SIS: b.SIS, Floor: floor.Name}
+			floor.Rooms = append(floor.Rooms, room)
+		}
+		room.Position, _ = f.Geometry.Point()
+		// The editor recomputes positions from the relative position, which
+		// would otherwise undo the import on the next save.
+		room.RelPosition = nil
+		if name := f.property("name"); len(name) > 0 {
+			room.Name = name
+		}
+		if typ := f.property("type"); len(typ) > 0 {
+			room.Type = typ
+		}
+	}
+	return changes, nil
+}
+
+func findFloor(b *models.Building, name string) *models.Floor {
+	for _, f := range b.Floors {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package geojson
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/d4l3k/campus/models"
+)
+
+func testBuildings() []*models.Building {
+	return []*models.Building{{
+		SIS:      "TST",
+		Name:     "Test Building",
+		Position: &models.LatLng{Lat: 49.2605, Lng: -123.2495},
+		Floors: []*models.Floor{{
+			Name:     "1",
+			Image:    "maps/tst/1.png",
+			Rotation: 0.5,
+			Coords:   &models.Coords{North: 49.261, South: 49.26, East: -123.249, West: -123.251},
+			Rooms: []*models.Room{
+				{Id: "101", Name: "Lecture Hall", SIS: "TST", Floor: "1", Position: &models.LatLng{Lat: 49.2604, Lng: -123.2502}},
+			},
+		}},
+	}}
+}
+
+// roundTrip exports the buildings to GeoJSON and decodes it again, as a
+// client would send it back.
+func roundTrip(t *testing.T, buildings []*models.Building) *FeatureCollection {
+	buf, err := json.Marshal(FromBuildings(buildings, Filter{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := &FeatureCollection{}
+	if err := json.Unmarshal(buf, fc); err != nil {
+		t.Fatal(err)
+	}
+	return fc
+}
+
+func coordsNear(a, b *models.Coords) bool {
+	const eps = 1e-9
+	return a != nil && b != nil && math.Abs(a.North-b.North) < eps && math.Abs(a.South-b.South) < eps &&
+		math.Abs(a.East-b.East) < eps && math.Abs(a.West-b.West) < eps
+}
+
+func TestMergeRoundTrip(t *testing.T) {
+	want := testBuildings()[0].Floors[0]
+	buildings := testBuildings()
+	fc := roundTrip(t, buildings)
+	// Merging repeatedly must not move the floor.
+	for i := 0; i < 3; i++ {
+		changes, err := Merge(buildings, fc, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != 2 || changes[0].Action != "update" || changes[1].Action != "update" {
+			t.Errorf("round %d: got changes %v, want the floor and room updated", i, changes)
+		}
+		fc = roundTrip(t, buildings)
+	}
+	got := buildings[0].Floors[0]
+	if !coordsNear(got.Coords, want.Coords) || got.Rotation != want.Rotation {
+		t.Errorf("got coords %+v rotation %g, want %+v rotation %g", got.Coords, got.Rotation, want.Coords, want.Rotation)
+	}
+	if room := got.Rooms[0]; room.Position.Lat != 49.2604 || room.Position.Lng != -123.2502 || room.Name != "Lecture Hall" {
+		t.Errorf("got room %+v at %+v", room, room.Position)
+	}
+}
+
+func TestMergeFootprintBounds(t *testing.T) {
+	buildings := testBuildings()
+	fc := roundTrip(t, buildings)
+	// Without the coords property the floor covers its footprint, which for a
+	// rotated floor is fitted within the coords.
+	for _, f := range fc.Features {
+		delete(f.Properties, "coords")
+	}
+	if _, err := Merge(buildings, fc, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buildings[0].Floors[0].Coords, testBuildings()[0].Floors[0].Coords; !coordsNear(got, want) {
+		t.Errorf("got coords %+v, want %+v", got, want)
+	}
+}
+
+func TestMergeInvalid(t *testing.T) {
+	cases := []struct {
+		name       string
+		properties map[string]interface{}
+		geometry   *Geometry
+	}{
+		{"unknown building", map[string]interface{}{"kind": KindRoom, "sis": "NOPE", "floor": "1", "id": "1"}, NewPoint(&models.LatLng{})},
+		{"unknown floor", map[string]interface{}{"kind": KindRoom, "sis": "TST", "floor": "9", "id": "1"}, NewPoint(&models.LatLng{})},
+		{"missing id", map[string]interface{}{"kind": KindRoom, "sis": "TST", "floor": "1"}, NewPoint(&models.LatLng{})},
+		{"inverted coords", map[string]interface{}{"kind": KindFloor, "sis": "TST", "floor": "2", "coords": map[string]interface{}{"north": 1, "south": 2, "east": 2, "west": 1}},
+			NewPolygon([]*models.LatLng{{Lat: 0, Lng: 0}, {Lat: 1, Lng: 0}, {Lat: 1, Lng: 1}})},
+	}
+	for _, c := range cases {
+		buildings := testBuildings()
+		fc := &FeatureCollection{Type: "FeatureCollection", Features: []*Feature{{Type: "Feature", Geometry: c.geometry, Properties: c.properties}}}
+		if _, err := Merge(buildings, fc, false); err == nil {
+			t.Errorf("%s: merged without an error", c.name)
+		}
+		if len(buildings[0].Floors) != 1 || len(buildings[0].Floors[0].Rooms) != 1 {
+			t.Errorf("%s: buildings were modified", c.name)
+		}
+	}
+}
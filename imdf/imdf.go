@@ -0,0 +1,485 @@
+// Package imdf exports the campus map data as an Apple Indoor Mapping Data
+// Format archive and reads such archives back.
+package imdf
+
+import (
+	"archive/zip"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/d4l3k/campus/geojson"
+	"github.com/d4l3k/campus/models"
+)
+
+// UnitSize is the width in metres of the square unit generated around each
+// room, since rooms only have a position.
+const UnitSize = 2
+
+// metresPerDegree is the approximate length of a degree of latitude.
+const metresPerDegree = 111320
+
+// unitCategories maps room types to IMDF unit categories. Anything else is a
+// "room".
+var unitCategories = map[string]string{
+	"restroom": "restroom",
+	"food":     "foodservice",
+	"bookable": "conferenceroom",
+	"stairs":   "stairs",
+	"elevator": "elevator",
+}
+
+// amenityCategories maps room types to IMDF amenity categories. Rooms of other
+// types don't get an amenity.
+var amenityCategories = map[string]string{
+	"restroom": "restroom",
+	"printer":  "copymachine",
+	"food":     "foodservice",
+	"stairs":   "stairs",
+	"elevator": "elevator",
+}
+
+type feature struct {
+	Id          string                 `json:"id"`
+	Type        string                 `json:"type"`
+	FeatureType string                 `json:"feature_type"`
+	Geometry    *geojson.Geometry      `json:"geometry"`
+	Properties  map[string]interface{} `json:"properties"`
+}
+
+type featureCollection struct {
+	Type     string     `json:"type"`
+	Name     string     `json:"name"`
+	Features []*feature `json:"features"`
+}
+
+type manifest struct {
+	Version     string `json:"version"`
+	Created     string `json:"created"`
+	Language    string `json:"language"`
+	GeneratedBy string `json:"generated_by"`
+}
+
+// featureTypes are the feature files in an archive, in the order they're
+// written.
+var featureTypes = []string{"venue", "building", "level", "unit", "amenity", "anchor"}
+
+// id returns a stable name based UUID so repeated exports keep their ids.
+func id(parts ...interface{}) string {
+	h := sha1.Sum([]byte(fmt.Sprint(parts...)))
+	h[6] = (h[6] & 0x0f) | 0x50
+	h[8] = (h[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+func label(s string) map[string]string {
+	if len(s) == 0 {
+		return nil
+	}
+	return map[string]string{"en": s}
+}
+
+func unlabel(v interface{}) string {
+	m, _ := v.(map[string]interface{})
+	s, _ := m["en"].(string)
+	return s
+}
+
+// square returns a square polygon centered on p.
+func square(p *models.LatLng, size float64) []*models.LatLng {
+	dLat := size / 2 / metresPerDegree
+	dLng := dLat / math.Cos(p.Lat*math.Pi/180)
+	return []*models.LatLng{
+		{Lat: p.Lat + dLat, Lng: p.Lng - dLng},
+		{Lat: p.Lat + dLat, Lng: p.Lng + dLng},
+		{Lat: p.Lat - dLat, Lng: p.Lng + dLng},
+		{Lat: p.Lat - dLat, Lng: p.Lng - dLng},
+	}
+}
+
+// ordinals returns the IMDF ordinal of each floor. Floors with numeric names
+// use the number. The others are stacked below the lowest numbered floor if
+// they come before every numbered floor, like basements, and above the highest
+// otherwise, so they never share an ordinal with a numbered floor.
+func ordinals(floors []*models.Floor) map[*models.Floor]int {
+	ords := make(map[*models.Floor]int)
+	min, max := math.MaxInt32, math.MinInt32
+	for _, f := range floors {
+		if n, err := strconv.Atoi(f.Name); err == nil {
+			ords[f] = n
+			if n < min {
+				min = n
+			}
+			if n > max {
+				max = n
+			}
+		}
+	}
+	// Without any numbered floors, they're all stacked up from the ground.
+	numbered := len(ords) == 0
+	if numbered {
+		max = -1
+	}
+	var below []*models.Floor
+	for _, f := range floors {
+		if _, ok := ords[f]; ok {
+			numbered = true
+			continue
+		}
+		if numbered {
+			max++
+			ords[f] = max
+		} else {
+			below = append(below, f)
+		}
+	}
+	// The floors below are listed bottom up.
+	for i, f := range below {
+		ords[f] = min - len(below) + i
+	}
+	return ords
+}
+
+// footprintRotation returns the rotation of a floor from its footprint, a ring
+// starting at the top left corner of the image as written by Write. It's the
+// inverse of models.Floor.RelToLatLng: the top edge of the image is scaled by
+// the sine and cosine of the rotation divided by the width of the rotated
+// image, and the left edge by the same over its height, so the products of
+// their components are proportional to sin² and cos².
+func footprintRotation(g *geojson.Geometry) float64 {
+	var rings [][][]float64
+	if err := json.Unmarshal(g.Coordinates, &rings); err != nil || len(rings) == 0 || len(rings[0]) < 4 {
+		return 0
+	}
+	r := rings[0]
+	for _, p := range r[:4] {
+		if len(p) < 2 {
+			return 0
+		}
+	}
+	// top is the top left to top right edge and left the top left to bottom
+	// left edge, as longitude and latitude deltas.
+	top := [2]float64{r[1][0] - r[0][0], r[1][1] - r[0][1]}
+	left := [2]float64{r[3][0] - r[0][0], r[3][1] - r[0][1]}
+	sin2 := top[1] * left[0]
+	cos2 := -top[0] * left[1]
+	if sin2 < 0 || cos2 < 0 || sin2+cos2 == 0 {
+		// Not a footprint written by Write.
+		return 0
+	}
+	sin := math.Copysign(math.Sqrt(sin2), -top[1])
+	cos := math.Copysign(math.Sqrt(cos2), top[0])
+	return math.Atan2(sin, cos)
+}
+
+// Write writes an IMDF archive of the buildings to w. The venue covers every
+// building and floor.
+func Write(w io.Writer, buildings []*models.Building, venueName string) error {
+	features := make(map[string][]*feature)
+	add := func(f *feature) {
+		f.Type = "Feature"
+		features[f.FeatureType] = append(features[f.FeatureType], f)
+	}
+
+	venueId := id("venue", venueName)
+	bounds := &models.Coords{
+		North: math.Inf(-1),
+		South: math.Inf(1),
+		East:  math.Inf(-1),
+		West:  math.Inf(1),
+	}
+	extend := func(p *models.LatLng) {
+		bounds.North = math.Max(bounds.North, p.Lat)
+		bounds.South = math.Min(bounds.South, p.Lat)
+		bounds.East = math.Max(bounds.East, p.Lng)
+		bounds.West = math.Min(bounds.West, p.Lng)
+	}
+
+	for _, b := range buildings {
+		if b.Position == nil {
+			continue
+		}
+		extend(b.Position)
+		buildingId := id("building", b.SIS)
+		add(&feature{
+			Id:          buildingId,
+			FeatureType: "building",
+			Properties: map[string]interface{}{
+				"category":      "unspecified",
+				"name":          label(b.Name),
+				"alt_name":      label(b.SIS),
+				"restriction":   nil,
+				"display_point": geojson.NewPoint(b.Position),
+				"address_id":    nil,
+			},
+		})
+		ords := ordinals(b.Floors)
+		for _, f := range b.Floors {
+			if f.Coords == nil {
+				continue
+			}
+			footprint := f.Footprint()
+			for _, p := range footprint {
+				extend(p)
+			}
+			levelId := id("level", b.SIS, f.Name)
+			add(&feature{
+				Id:          levelId,
+				FeatureType: "level",
+				Geometry:    geojson.NewPolygon(footprint),
+				Properties: map[string]interface{}{
+					"category":      "unspecified",
+					"restriction":   nil,
+					"outdoor":       false,
+					"ordinal":       ords[f],
+					"name":          label(b.Name + " " + f.Name),
+					"short_name":    label(f.Name),
+					"display_point": nil,
+					"address_id":    nil,
+					"building_ids":  []string{buildingId},
+				},
+			})
+			for _, r := range f.Rooms {
+				if r.Position == nil {
+					continue
+				}
+				unitId := id("unit", b.SIS, f.Name, r.Id)
+				category, ok := unitCategories[r.Type]
+				if !ok {
+					category = "room"
+				}
+				add(&feature{
+					Id:          unitId,
+					FeatureType: "unit",
+					Geometry:    geojson.NewPolygon(square(r.Position, UnitSize)),
+					Properties: map[string]interface{}{
+						"category":      category,
+						"restriction":   nil,
+						"accessibility": nil,
+						"name":          label(r.Name),
+						"alt_name":      label(r.Id),
+						"level_id":      levelId,
+						"display_point": geojson.NewPoint(r.Position),
+					},
+				})
+				add(&feature{
+					Id:          id("anchor", b.SIS, f.Name, r.Id),
+					FeatureType: "anchor",
+					Geometry:    geojson.NewPoint(r.Position),
+					Properties: map[string]interface{}{
+						"address_id": nil,
+						"unit_id":    unitId,
+					},
+				})
+				if category, ok := amenityCategories[r.Type]; ok {
+					add(&feature{
+						Id:          id("amenity", b.SIS, f.Name, r.Id),
+						FeatureType: "amenity",
+						Geometry:    geojson.NewPoint(r.Position),
+						Properties: map[string]interface{}{
+							"category":       category,
+							"accessibility":  nil,
+							"name":           label(r.Name),
+							"alt_name":       label(r.Id),
+							"hours":          nil,
+							"phone":          nil,
+							"website":        nil,
+							"unit_ids":       []string{unitId},
+							"address_id":     nil,
+							"correlation_id": nil,
+						},
+					})
+				}
+			}
+		}
+	}
+
+	venue := &feature{
+		Id:          venueId,
+		FeatureType: "venue",
+		Properties: map[string]interface{}{
+			"category":    "university",
+			"restriction": nil,
+			"name":        label(venueName),
+			"alt_name":    nil,
+			"hours":       nil,
+			"phone":       nil,
+			"website":     nil,
+			"address_id":  nil,
+		},
+	}
+	if !math.IsInf(bounds.North, 0) {
+		venue.Geometry = geojson.NewPolygon([]*models.LatLng{
+			{Lat: bounds.North, Lng: bounds.West},
+			{Lat: bounds.North, Lng: bounds.East},
+			{Lat: bounds.South, Lng: bounds.East},
+			{Lat: bounds.South, Lng: bounds.West},
+		})
+		venue.Properties["display_point"] = geojson.NewPoint(&models.LatLng{
+			Lat: (bounds.North + bounds.South) / 2,
+			Lng: (bounds.East + bounds.West) / 2,
+		})
+	}
+	add(venue)
+
+	z := zip.NewWriter(w)
+	mw, err := z.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(mw).Encode(&manifest{
+		Version:     "1.0.0",
+		Created:     time.Now().UTC().Format(time.RFC3339),
+		Language:    "en",
+		GeneratedBy: "campus",
+	}); err != nil {
+		return err
+	}
+	for _, typ := range featureTypes {
+		fw, err := z.Create(typ + ".geojson")
+		if err != nil {
+			return err
+		}
+		fc := &featureCollection{
+			Type:     "FeatureCollection",
+			Name:     typ,
+			Features: features[typ],
+		}
+		if fc.Features == nil {
+			fc.Features = []*feature{}
+		}
+		if err := json.NewEncoder(fw).Encode(fc); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+// Read reads buildings, levels and units back from an IMDF archive written by
+// Write. Floors get the bounding box of their level as coords, the rotation of
+// its footprint and rooms the position of their anchor.
+func Read(r io.ReaderAt, size int64) ([]*models.Building, error) {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	features := make(map[string][]*feature)
+	for _, f := range z.File {
+		for _, typ := range featureTypes {
+			if f.Name != typ+".geojson" {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			var fc featureCollection
+			err = json.NewDecoder(rc).Decode(&fc)
+			rc.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", f.Name, err)
+			}
+			features[typ] = fc.Features
+		}
+	}
+
+	types := make(map[string]string)
+	for typ, category := range unitCategories {
+		types[category] = typ
+	}
+	amenityTypes := make(map[string]string)
+	for typ, category := range amenityCategories {
+		amenityTypes[category] = typ
+	}
+	unitTypes := make(map[string]string)
+	for _, f := range features["amenity"] {
+		category, _ := f.Properties["category"].(string)
+		ids, _ := f.Properties["unit_ids"].([]interface{})
+		for _, unitId := range ids {
+			if unitId, ok := unitId.(string); ok {
+				unitTypes[unitId] = amenityTypes[category]
+			}
+		}
+	}
+
+	var buildings []*models.Building
+	buildingsById := make(map[string]*models.Building)
+	for _, f := range features["building"] {
+		b := &models.Building{
+			Name: unlabel(f.Properties["name"]),
+			SIS:  unlabel(f.Properties["alt_name"]),
+		}
+		if p, err := json.Marshal(f.Properties["display_point"]); err == nil {
+			var g geojson.Geometry
+			if json.Unmarshal(p, &g) == nil {
+				b.Position, _ = g.Point()
+			}
+		}
+		buildings = append(buildings, b)
+		buildingsById[f.Id] = b
+	}
+
+	floors := make(map[string]*models.Floor)
+	floorBuildings := make(map[*models.Floor]*models.Building)
+	for _, f := range features["level"] {
+		ids, _ := f.Properties["building_ids"].([]interface{})
+		if len(ids) == 0 || f.Geometry == nil {
+			continue
+		}
+		buildingId, _ := ids[0].(string)
+		b := buildingsById[buildingId]
+		if b == nil {
+			return nil, fmt.Errorf("level %s: unknown building %s", f.Id, buildingId)
+		}
+		coords, err := f.Geometry.Bounds()
+		if err != nil {
+			return nil, fmt.Errorf("level %s: %s", f.Id, err)
+		}
+		floor := &models.Floor{
+			Name:     unlabel(f.Properties["short_name"]),
+			Coords:   coords,
+			Rotation: footprintRotation(f.Geometry),
+		}
+		b.Floors = append(b.Floors, floor)
+		floors[f.Id] = floor
+		floorBuildings[floor] = b
+	}
+
+	positions := make(map[string]*models.LatLng)
+	for _, f := range features["anchor"] {
+		unitId, _ := f.Properties["unit_id"].(string)
+		if f.Geometry == nil {
+			continue
+		}
+		p, err := f.Geometry.Point()
+		if err != nil {
+			return nil, fmt.Errorf("anchor %s: %s", f.Id, err)
+		}
+		positions[unitId] = p
+	}
+	for _, f := range features["unit"] {
+		levelId, _ := f.Properties["level_id"].(string)
+		floor := floors[levelId]
+		if floor == nil {
+			return nil, fmt.Errorf("unit %s: unknown level %s", f.Id, levelId)
+		}
+		typ, ok := unitTypes[f.Id]
+		if !ok {
+			category, _ := f.Properties["category"].(string)
+			typ = types[category]
+		}
+		floor.Rooms = append(floor.Rooms, &models.Room{
+			Id:       unlabel(f.Properties["alt_name"]),
+			SIS:      floorBuildings[floor].SIS,
+			Name:     unlabel(f.Properties["name"]),
+			Type:     typ,
+			Floor:    floor.Name,
+			Position: positions[f.Id],
+		})
+	}
+	return buildings, nil
+}
@@ -0,0 +1,130 @@
+package imdf
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/d4l3k/campus/models"
+)
+
+func TestWriteRead(t *testing.T) {
+	buildings := []*models.Building{
+		{
+			Name:     "Test Building",
+			SIS:      "TST",
+			Position: &models.LatLng{Lat: 49.26, Lng: -123.25},
+			Floors: []*models.Floor{
+				{
+					Name:   "1",
+					Coords: &models.Coords{North: 49.261, South: 49.259, East: -123.249, West: -123.251},
+					Rooms: []*models.Room{
+						{Id: "101", Name: "Lecture Hall", Position: &models.LatLng{Lat: 49.2601, Lng: -123.2501}},
+						{Id: "102", Name: "Washroom", Type: "restroom", Position: &models.LatLng{Lat: 49.2602, Lng: -123.2502}},
+						{Id: "103", Type: "printer", Position: &models.LatLng{Lat: 49.2603, Lng: -123.2503}},
+					},
+				},
+				{
+					Name:     "2",
+					Coords:   &models.Coords{North: 49.261, South: 49.259, East: -123.249, West: -123.251},
+					Rotation: 0.4,
+					Rooms: []*models.Room{
+						{Id: "201", Name: "Meeting Room", Type: "bookable", Position: &models.LatLng{Lat: 49.2604, Lng: -123.2504}},
+					},
+				},
+				{
+					Name:     "3",
+					Coords:   &models.Coords{North: 49.2612, South: 49.2595, East: -123.2488, West: -123.2512},
+					Rotation: -2.1,
+				},
+			},
+		},
+		// Buildings without a position aren't exported.
+		{Name: "Nowhere", SIS: "NOW"},
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, buildings, "Test Campus"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("got %d buildings, want 1", len(got))
+	}
+	want := buildings[0]
+	b := got[0]
+	if b.Name != want.Name || b.SIS != want.SIS || !samePosition(b.Position, want.Position) {
+		t.Errorf("got building %q %q %+v, want %q %q %+v", b.Name, b.SIS, b.Position, want.Name, want.SIS, want.Position)
+	}
+	if len(b.Floors) != len(want.Floors) {
+		t.Fatalf("got %d floors, want %d", len(b.Floors), len(want.Floors))
+	}
+	for i, f := range b.Floors {
+		wf := want.Floors[i]
+		if f.Name != wf.Name {
+			t.Errorf("floor %d: got name %q, want %q", i, f.Name, wf.Name)
+		}
+		if !sameCoords(f.Coords, wf.Coords) {
+			t.Errorf("floor %s: got coords %+v, want %+v", wf.Name, f.Coords, wf.Coords)
+		}
+		if math.Abs(f.Rotation-wf.Rotation) > epsilon {
+			t.Errorf("floor %s: got rotation %g, want %g", wf.Name, f.Rotation, wf.Rotation)
+		}
+		if len(f.Rooms) != len(wf.Rooms) {
+			t.Errorf("floor %s: got %d rooms, want %d", wf.Name, len(f.Rooms), len(wf.Rooms))
+			continue
+		}
+		for j, r := range f.Rooms {
+			wr := wf.Rooms[j]
+			if r.Id != wr.Id || r.Name != wr.Name || r.Type != wr.Type || r.SIS != want.SIS || r.Floor != wf.Name || !samePosition(r.Position, wr.Position) {
+				t.Errorf("floor %s: got room %+v at %+v, want %+v at %+v", wf.Name, r, r.Position, wr, wr.Position)
+			}
+		}
+	}
+}
+
+func TestOrdinals(t *testing.T) {
+	cases := []struct {
+		names []string
+		want  []int
+	}{
+		{[]string{"1", "2", "3"}, []int{1, 2, 3}},
+		{[]string{"B", "1", "2"}, []int{0, 1, 2}},
+		{[]string{"B2", "B1", "1", "2"}, []int{-1, 0, 1, 2}},
+		{[]string{"0", "1", "M", "2"}, []int{0, 1, 3, 2}},
+		{[]string{"B", "G", "M"}, []int{0, 1, 2}},
+	}
+	for _, c := range cases {
+		var floors []*models.Floor
+		for _, name := range c.names {
+			floors = append(floors, &models.Floor{Name: name})
+		}
+		ords := ordinals(floors)
+		for i, f := range floors {
+			if ords[f] != c.want[i] {
+				t.Errorf("floors %v: got ordinal %d for %s, want %d", c.names, ords[f], f.Name, c.want[i])
+			}
+		}
+	}
+}
+
+const epsilon = 1e-9
+
+func samePosition(a, b *models.LatLng) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return math.Abs(a.Lat-b.Lat) < epsilon && math.Abs(a.Lng-b.Lng) < epsilon
+}
+
+func sameCoords(a, b *models.Coords) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return math.Abs(a.North-b.North) < epsilon && math.Abs(a.South-b.South) < epsilon &&
+		math.Abs(a.East-b.East) < epsilon && math.Abs(a.West-b.West) < epsilon
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	goregexp "regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/analysis/analyzer/standard"
+	"github.com/blevesearch/bleve/analysis/char/regexp"
+	"github.com/blevesearch/bleve/analysis/token/edgengram"
+	"github.com/blevesearch/bleve/analysis/token/lowercase"
+	"github.com/blevesearch/bleve/analysis/tokenizer/unicode"
+	"github.com/blevesearch/bleve/index/scorch"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/d4l3k/campus/models"
+)
+
+// indexVersion must be bumped whenever the index mapping or indexed fields
+// change so existing indexes are rebuilt.
+const indexVersion = 5
+
+const (
+	// idAnalyzer indexes ids and names as prefixes of their normalized
+	// terms, so "mcl" and "20" both find "MCLD 202".
+	idAnalyzer = "campus_id"
+	// queryAnalyzer normalizes queries the same way without the prefixes.
+	queryAnalyzer = "campus_query"
+)
+
+// Search modes. Exact only matches whole query string terms, prefix also
+// matches the beginnings of ids, names and aliases and fuzzy also tolerates
+// typos.
+const (
+	modeExact  = "exact"
+	modePrefix = "prefix"
+	modeFuzzy  = "fuzzy"
+)
+
+// textFields are the fields matched by prefix and fuzzy searches.
+var textFields = []string{"Id", "Name", "Aliases"}
+
+// sisRoomRegexp matches a building code followed by a room number without a
+// space.
+var sisRoomRegexp = goregexp.MustCompile(`([a-zA-Z])([0-9])`)
+
+// mapHashKey is the internal index key storing the hash of the map data the
+// index was built from.
+var mapHashKey = []byte("mapHash")
+
+// mapDataHash returns the hash of the map data and index version.
+func mapDataHash() ([]byte, error) {
+	buf, err := ioutil.ReadFile(models.MapDataPath)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write([]byte(strconv.Itoa(indexVersion)))
+	h.Write(buf)
+	return h.Sum(nil), nil
+}
+
+// openIndex opens the search index and returns whether it is current with the
+// map data hash. Without an index path a temporary index is created, which is
+// removed by Close. Indexes that are out of date or fail to open are rebuilt.
+func (s *Server) openIndex(hash []byte) (bleve.Index, bool, error) {
+	path := *indexPath
+	if len(path) == 0 {
+		dir, err := ioutil.TempDir("", "campus")
+		if err != nil {
+			return nil, false, err
+		}
+		s.indexTemp = dir
+		path = filepath.Join(dir, "index.bleve")
+	} else if index, err := bleve.Open(path); err == nil {
+		stored, err := index.GetInternal(mapHashKey)
+		if err == nil && string(stored) == string(hash) {
+			log.Printf("Reusing index %s", path)
+			return index, true, nil
+		}
+		log.Printf("Index %s is out of date; rebuilding", path)
+		index.Close()
+		if err := os.RemoveAll(path); err != nil {
+			return nil, false, err
+		}
+	} else if err != bleve.ErrorIndexPathDoesNotExist {
+		log.Printf("Failed to open index %s, rebuilding: %s", path, err)
+		if err := os.RemoveAll(path); err != nil {
+			return nil, false, err
+		}
+	}
+
+	log.Printf("Index file %s", path)
+	m, err := indexMapping()
+	if err != nil {
+		return nil, false, err
+	}
+	index, err := bleve.NewUsing(path, m, scorch.Name, scorch.Name, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	return index, false, nil
+}
+
+// Close closes the search index and analytics, removing the index if it was
+// temporary.
+func (s *Server) Close() error {
+	if s.analytics != nil {
+		if err := s.analytics.Close(); err != nil {
+			return err
+		}
+	}
+	if s.mbtiles != nil {
+		if err := s.mbtiles.Close(); err != nil {
+			return err
+		}
+	}
+	if err := s.index.Close(); err != nil {
+		return err
+	}
+	if len(s.indexTemp) > 0 {
+		return os.RemoveAll(s.indexTemp)
+	}
+	return nil
+}
+
+// indexMapping returns the mapping for models.Index documents.
+func indexMapping() (mapping.IndexMapping, error) {
+	m := bleve.NewIndexMapping()
+	// Split building codes from room numbers, e.g. "mcld202" to "mcld 202".
+	if err := m.AddCustomCharFilter("sis_room", map[string]interface{}{
+		"type":    regexp.Name,
+		"regexp":  sisRoomRegexp.String(),
+		"replace": "$1 $2",
+	}); err != nil {
+		return nil, err
+	}
+	if err := m.AddCustomTokenFilter("prefix", map[string]interface{}{
+		"type": edgengram.Name,
+		"min":  1.0,
+		"max":  20.0,
+	}); err != nil {
+		return nil, err
+	}
+	if err := m.AddCustomAnalyzer(idAnalyzer, map[string]interface{}{
+		"type":          custom.Name,
+		"char_filters":  []string{"sis_room"},
+		"tokenizer":     unicode.Name,
+		"token_filters": []string{lowercase.Name, "prefix"},
+	}); err != nil {
+		return nil, err
+	}
+	if err := m.AddCustomAnalyzer(queryAnalyzer, map[string]interface{}{
+		"type":          custom.Name,
+		"char_filters":  []string{"sis_room"},
+		"tokenizer":     unicode.Name,
+		"token_filters": []string{lowercase.Name},
+	}); err != nil {
+		return nil, err
+	}
+
+	id := bleve.NewTextFieldMapping()
+	id.Analyzer = idAnalyzer
+	typ := bleve.NewTextFieldMapping()
+	typ.Analyzer = keyword.Name
+	description := bleve.NewTextFieldMapping()
+	description.Analyzer = standard.Name
+	image := bleve.NewTextFieldMapping()
+	image.Index = false
+	image.IncludeInAll = false
+
+	doc := bleve.NewDocumentMapping()
+	doc.AddFieldMappingsAt("Id", id)
+	doc.AddFieldMappingsAt("Name", id)
+	doc.AddFieldMappingsAt("Aliases", id)
+	doc.AddFieldMappingsAt("Type", typ)
+	doc.AddFieldMappingsAt("SIS", typ)
+	doc.AddFieldMappingsAt("Floor", typ)
+	doc.AddFieldMappingsAt("Location", bleve.NewGeoPointFieldMapping())
+	doc.AddFieldMappingsAt("Description", description)
+	doc.AddFieldMappingsAt("Image", image)
+	doc.AddFieldMappingsAt("Accessible", bleve.NewBooleanFieldMapping())
+	m.DefaultMapping = doc
+	return m, nil
+}
+
+// textQuery matches q against the ids, names and aliases of items.
+func textQuery(q string) *query.DisjunctionQuery {
+	var fields []query.Query
+	for _, field := range textFields {
+		match := bleve.NewMatchQuery(q)
+		match.SetField(field)
+		match.Analyzer = queryAnalyzer
+		fields = append(fields, match)
+	}
+	return bleve.NewDisjunctionQuery(fields...)
+}
+
+// synonyms maps lowercase search terms to the terms equivalent to them.
+type synonyms map[string][]string
+
+// loadSynonyms reads a synonyms file where each line is a comma separated list
+// of equivalent terms. Blank lines and lines starting with # are ignored. A
+// missing file has no synonyms.
+func loadSynonyms(path string) (synonyms, error) {
+	syns := make(synonyms)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		log.Printf("No synonyms file %s", path)
+		return syns, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var terms []string
+		for _, term := range strings.Split(line, ",") {
+			if term = strings.ToLower(strings.TrimSpace(term)); len(term) > 0 {
+				terms = append(terms, term)
+			}
+		}
+		for _, term := range terms {
+			for _, other := range terms {
+				if other != term {
+					syns[term] = append(syns[term], other)
+				}
+			}
+		}
+	}
+	return syns, scanner.Err()
+}
+
+// expand returns the synonyms of the terms that aren't terms themselves.
+func (syns synonyms) expand(terms []string) []string {
+	seen := make(map[string]bool)
+	for _, term := range terms {
+		seen[term] = true
+	}
+	var expanded []string
+	for _, term := range terms {
+		for _, syn := range syns[term] {
+			if !seen[syn] {
+				seen[syn] = true
+				expanded = append(expanded, syn)
+			}
+		}
+	}
+	return expanded
+}
+
+// searchQuery returns the query for q in the search mode. Query string matches
+// are blended with boosted prefix matches and, in fuzzy mode, with matches of
+// terms a typo or two away. Synonyms of the terms match types, ids, names and
+// aliases in every mode.
+func (s *Server) searchQuery(q, mode string) (query.Query, error) {
+	queries := []query.Query{bleve.NewQueryStringQuery(q)}
+	var terms []string
+	analyzer := s.index.Mapping().AnalyzerNamed(queryAnalyzer)
+	for _, token := range analyzer.Analyze([]byte(q)) {
+		terms = append(terms, string(token.Term))
+	}
+	for _, syn := range s.synonyms.expand(terms) {
+		typeQuery := bleve.NewTermQuery(syn)
+		typeQuery.SetField("Type")
+		queries = append(queries, typeQuery, textQuery(syn))
+	}
+
+	switch mode {
+	case modeExact:
+	case modeFuzzy:
+		for _, term := range terms {
+			// Short terms are within a typo of too many prefixes.
+			if len(term) < 3 {
+				continue
+			}
+			fuzziness := 1
+			if len(term) > 4 {
+				fuzziness = 2
+			}
+			for _, field := range textFields {
+				fuzzy := bleve.NewFuzzyQuery(term)
+				fuzzy.SetField(field)
+				fuzzy.SetFuzziness(fuzziness)
+				fuzzy.SetBoost(0.5)
+				queries = append(queries, fuzzy)
+			}
+		}
+		fallthrough
+	case modePrefix:
+		prefix := textQuery(q)
+		prefix.SetBoost(2)
+		queries = append(queries, prefix)
+	default:
+		return nil, fmt.Errorf("unknown search mode %q", mode)
+	}
+	return bleve.NewDisjunctionQuery(queries...), nil
+}
+
+// lookupExact returns the item whose id is q, ignoring case and allowing the
+// building code and room number to be written together or with a dash.
+func (s *Server) lookupExact(q string) (*models.Index, bool) {
+	if idx, ok := s.lookup(q); ok {
+		return idx, true
+	}
+	id := strings.Join(strings.Fields(strings.ToUpper(strings.Replace(q, "-", " ", -1))), " ")
+	if idx, ok := s.lookup(id); ok {
+		return idx, true
+	}
+	return s.lookup(sisRoomRegexp.ReplaceAllString(id, "$1 $2"))
+}
+
+// floorPenalty is the distance in meters added to a result for every floor
+// it is away from the searcher.
+const floorPenalty = 20
+
+// origin is where a search is made from.
+type origin struct {
+	Position *models.LatLng
+	Floor    string
+}
+
+// parseOrigin returns the origin from the lat, lng and floor parameters, or nil
+// if there is no position.
+func parseOrigin(query url.Values) (*origin, error) {
+	if len(query.Get("lat")) == 0 && len(query.Get("lng")) == 0 {
+		return nil, nil
+	}
+	lat, err := strconv.ParseFloat(query.Get("lat"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lat: %s", err)
+	}
+	lng, err := strconv.ParseFloat(query.Get("lng"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lng: %s", err)
+	}
+	return &origin{
+		Position: &models.LatLng{Lat: lat, Lng: lng},
+		Floor:    query.Get("floor"),
+	}, nil
+}
+
+// floorsApart returns how many floors apart two floors are. Floors that aren't
+// numbered are one floor apart.
+func floorsApart(a, b string) float64 {
+	if a == b {
+		return 0
+	}
+	i, errA := strconv.Atoi(a)
+	j, errB := strconv.Atoi(b)
+	if errA != nil || errB != nil {
+		return 1
+	}
+	return math.Abs(float64(i - j))
+}
+
+// distance returns the distance in meters to the item, penalizing floor
+// changes.
+func (o *origin) distance(idx *models.Index) float64 {
+	if idx.Location == nil {
+		return math.Inf(1)
+	}
+	d := o.Position.Distance(idx.Location)
+	if len(o.Floor) > 0 && len(idx.Floor) > 0 {
+		d += floorPenalty * floorsApart(o.Floor, idx.Floor)
+	}
+	return d
+}
+
+// matchedFragments returns the highlighted fragments, dropping the ones
+// returned for fields without any matches.
+func matchedFragments(fragments search.FieldFragmentMap) map[string][]string {
+	var matched map[string][]string
+	for field, frags := range fragments {
+		for _, frag := range frags {
+			if !strings.Contains(frag, "<mark>") {
+				continue
+			}
+			if matched == nil {
+				matched = make(map[string][]string)
+			}
+			matched[field] = append(matched[field], frag)
+		}
+	}
+	return matched
+}
+
+// searchIndex runs the search request and returns up to size matching items
+// after skipping from. With an origin the items are the nearest ones instead of
+// the most relevant.
+func (s *Server) searchIndex(req *bleve.SearchRequest, o *origin, from, size int) ([]*SearchHit, *bleve.SearchResult, error) {
+	req.From = from
+	req.Size = size
+	if o != nil {
+		// Fetch extra candidates since floor penalties can reorder them.
+		req.From = 0
+		req.Size = (from + size) * 4
+		geoSort, err := search.NewSortGeoDistance("Location", "m", o.Position.Lng, o.Position.Lat, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.SortByCustom(search.SortOrder{geoSort})
+	}
+	result, err := s.index.Search(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	var items []*SearchHit
+	for _, hit := range result.Hits {
+		if idx, ok := s.lookup(hit.ID); ok {
+			items = append(items, &SearchHit{
+				Index:       idx,
+				Fragments:   matchedFragments(hit.Fragments),
+				Explanation: hit.Expl,
+			})
+		}
+	}
+	if o != nil {
+		sort.SliceStable(items, func(i, j int) bool {
+			return o.distance(items[i].Index) < o.distance(items[j].Index)
+		})
+		if len(items) > from {
+			items = items[from:]
+		} else {
+			items = nil
+		}
+	}
+	if len(items) > size {
+		items = items[:size]
+	}
+	return items, result, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/d4l3k/campus/models"
+	"github.com/gorilla/mux"
+)
+
+// testServer has the bundled map data indexed. It's shared by the search tests
+// since indexing takes a while.
+var testServer *Server
+
+func TestMain(m *testing.M) {
+	store, err := models.LoadStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	testServer = &Server{store: store}
+	if testServer.synonyms, err = loadSynonyms(*synonymsPath); err != nil {
+		log.Fatal(err)
+	}
+	testServer.indexBuildings()
+	code := m.Run()
+	testServer.Close()
+	os.Exit(code)
+}
+
+// searchFor runs a search with the query parameters against testServer.
+func searchFor(t *testing.T, params url.Values) *SearchResp {
+	r := httptest.NewRequest("GET", "/api/search/?"+params.Encode(), nil)
+	w := httptest.NewRecorder()
+	testServer.search(w, r)
+	if w.Code != 200 {
+		t.Fatalf("search %s: got status %d: %s", params.Encode(), w.Code, w.Body.String())
+	}
+	var resp SearchResp
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return &resp
+}
+
+// hitIds returns the ids of the search hits.
+func hitIds(resp *SearchResp) []string {
+	var ids []string
+	for _, hit := range resp.Hits {
+		ids = append(ids, hit.Id)
+	}
+	return ids
+}
+
+// TestSearchMapping checks that room numbers, building codes and aliases are
+// found however they're written.
+func TestSearchMapping(t *testing.T) {
+	cases := []struct {
+		q    string
+		typ  string
+		want string
+		// within is how many of the first hits want must be in.
+		within int
+	}{
+		{q: "MCLD 202", want: "MCLD 202", within: 1},
+		{q: "mcld202", want: "MCLD 202", within: 1},
+		{q: "MCLD-202", want: "MCLD 202", within: 1},
+		{q: "iccs x150", want: "ICCS X150", within: 1},
+		{q: "ICCS", want: "ICCS", within: 1},
+		{q: "Demco", want: "ICCS X150", within: 1},
+		{q: "Hugh Dempster", want: "DMP", within: 1},
+		{q: "dempster", want: "DMP", within: 3},
+		{q: "ICICS", want: "ICCS", within: 3},
+		{q: "ICICS", typ: "building", want: "ICCS", within: 1},
+		{q: "Institute for Computing", typ: "building", want: "ICCS", within: 1},
+	}
+	for _, c := range cases {
+		params := url.Values{"q": {c.q}, "size": {"10"}}
+		if len(c.typ) > 0 {
+			params.Set("type", c.typ)
+		}
+		ids := hitIds(searchFor(t, params))
+		found := false
+		for i := 0; i < c.within && i < len(ids); i++ {
+			if ids[i] == c.want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("search %q type %q: want %q in the first %d hits, got %v", c.q, c.typ, c.want, c.within, ids)
+		}
+	}
+}
+
+// TestSearchModes checks what each search mode matches.
+func TestSearchModes(t *testing.T) {
+	cases := []struct {
+		q, mode string
+		// want are the first hits, in any order.
+		want []string
+		// total is the number of hits, or -1 to not check it.
+		total int
+	}{
+		// Exact id matches are the only result in exact mode.
+		{q: "MCLD 202", mode: modeExact, want: []string{"MCLD 202"}, total: 1},
+		{q: "mcld202", mode: modeExact, want: []string{"MCLD 202"}, total: 1},
+		{q: "dempstr", mode: modeExact, total: 0},
+		{q: "Macleud", mode: modeExact, total: 0},
+
+		// Exact id matches are ranked before longer ids they prefix.
+		{q: "mcld202", mode: modePrefix, want: []string{"MCLD 202"}, total: -1},
+		{q: "mcld202", mode: modePrefix, want: []string{"MCLD 202", "MCLD 202A", "MCLD 202B"}, total: -1},
+		{q: "iccs x15", mode: modePrefix, want: []string{"ICCS X153", "ICCS X151", "ICCS X150"}, total: -1},
+		{q: "demps", mode: modePrefix, want: []string{"DMP"}, total: -1},
+		{q: "dempstr", mode: modePrefix, total: 0},
+
+		// Typos are tolerated in fuzzy mode.
+		{q: "dempstr", mode: modeFuzzy, want: []string{"DMP"}, total: -1},
+		{q: "Macleud", mode: modeFuzzy, want: []string{"MCLD"}, total: -1},
+		{q: "MCLD 202", mode: modeFuzzy, want: []string{"MCLD 202"}, total: -1},
+	}
+	for _, c := range cases {
+		resp := searchFor(t, url.Values{"q": {c.q}, "mode": {c.mode}})
+		ids := hitIds(resp)
+		if c.total >= 0 && resp.Total != uint64(c.total) {
+			t.Errorf("search %q mode %s: got %d hits %v, want %d", c.q, c.mode, resp.Total, ids, c.total)
+		}
+		if len(ids) < len(c.want) {
+			t.Errorf("search %q mode %s: got hits %v, want them to start with %v", c.q, c.mode, ids, c.want)
+			continue
+		}
+		first := make(map[string]bool)
+		for _, id := range ids[:len(c.want)] {
+			first[id] = true
+		}
+		for _, id := range c.want {
+			if !first[id] {
+				t.Errorf("search %q mode %s: got hits %v, want them to start with %v", c.q, c.mode, ids, c.want)
+				break
+			}
+		}
+	}
+}
+
+// TestSearchSynonyms checks that the bundled synonyms file makes equivalent
+// terms find the same items, and that aliases find the canonical building.
+func TestSearchSynonyms(t *testing.T) {
+	if syns := testServer.synonyms.expand([]string{"washroom"}); len(syns) == 0 || syns[0] != "restroom" {
+		t.Fatalf("washroom expanded to %v, want restroom first", syns)
+	}
+
+	restrooms := searchFor(t, url.Values{"q": {"restroom"}, "size": {"100"}})
+	if restrooms.Total == 0 {
+		t.Fatal("no restrooms found")
+	}
+	for _, q := range []string{"washroom", "bathroom", "Toilet", "wc"} {
+		resp := searchFor(t, url.Values{"q": {q}, "size": {"100"}})
+		if resp.Total != restrooms.Total {
+			t.Errorf("search %q: got %d hits, want the %d restrooms", q, resp.Total, restrooms.Total)
+		}
+		for _, hit := range resp.Hits {
+			if hit.Type != "restroom" {
+				t.Errorf("search %q: got %s of type %q", q, hit.Id, hit.Type)
+			}
+		}
+	}
+
+	for _, q := range []string{"ICICS", "Institute for Computing", "icics"} {
+		ids := hitIds(searchFor(t, url.Values{"q": {q}, "type": {"building"}}))
+		if len(ids) == 0 || ids[0] != "ICCS" {
+			t.Errorf("search %q: got buildings %v, want ICCS first", q, ids)
+		}
+	}
+}
+
+// TestNearestSize checks that nearest searches return at most maxSearchSize
+// results, ordered by distance. There are more departments than that.
+func TestNearestSize(t *testing.T) {
+	iccs := testServer.store.Building("ICCS").Position
+	params := url.Values{
+		"lat":  {fmt.Sprint(iccs.Lat)},
+		"lng":  {fmt.Sprint(iccs.Lng)},
+		"size": {"1000000"},
+	}
+	r := mux.SetURLVars(httptest.NewRequest("GET", "/api/nearest/department?"+params.Encode(), nil), map[string]string{"type": "department"})
+	w := httptest.NewRecorder()
+	testServer.nearest(w, r)
+	if w.Code != 200 {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+	var hits []*SearchHit
+	if err := json.NewDecoder(w.Body).Decode(&hits); err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != maxSearchSize {
+		t.Errorf("got %d departments, want %d", len(hits), maxSearchSize)
+	}
+	if len(hits) > 0 && hits[0].SIS != "ICCS" {
+		t.Errorf("got nearest department %s in %s, want one in ICCS", hits[0].Id, hits[0].SIS)
+	}
+	for i := 1; i < len(hits); i++ {
+		if hits[i].Location.Distance(iccs) < hits[i-1].Location.Distance(iccs) {
+			t.Errorf("hit %d %s is closer than hit %d %s", i, hits[i].Id, i-1, hits[i-1].Id)
+		}
+	}
+}
@@ -1,13 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
@@ -16,11 +25,16 @@ import (
 	"google.golang.org/api/googleapi/transport"
 	"google.golang.org/api/vision/v1"
 
-	"github.com/BurntSushi/graphics-go/graphics"
 	"github.com/PuerkitoBio/goquery"
 	"github.com/abbot/go-http-auth"
 	"github.com/blevesearch/bleve"
 	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/highlight/format/html"
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/d4l3k/campus/analytics"
+	"github.com/d4l3k/campus/geojson"
+	"github.com/d4l3k/campus/imdf"
+	"github.com/d4l3k/campus/mbtiles"
 	"github.com/d4l3k/campus/models"
 	"github.com/golang/groupcache"
 	"github.com/gorilla/handlers"
@@ -37,17 +51,37 @@ var (
 	cacheToken         = flag.Bool("cachetoken", true, "cache the OAuth 2.0 token")
 	addr               = flag.String("addr", ":8383", "the address to listen on")
 	debug              = flag.Bool("debug", false, "whether to run in debug mode")
+	historyPath        = flag.String("history", "./history", "the directory to store building revisions in")
+	indexPath          = flag.String("index", "", "the search index to reuse across restarts; defaults to a temporary one")
+	analyticsPath      = flag.String("analytics", "", "the database to record searches in; disabled if empty")
+	mbtilesPath        = flag.String("mbtiles", "", "the MBTiles file of prerendered tiles to serve")
+	synonymsPath       = flag.String("synonyms", "./static/maps/synonyms.txt", "the file of search terms to treat as equivalent")
+	venueName          = flag.String("venue", "University of British Columbia", "the name of the campus in exports")
 )
 
 const TileSize = 256
 
 type Server struct {
-	r                *mux.Router
-	buildings        []*models.Building
-	zoomedFloorCache *groupcache.Group
-	index            bleve.Index
-	idIndex          map[string]*models.Index
-	authenticator    auth.AuthenticatorInterface
+	r              *mux.Router
+	store          *models.Store
+	floorTileCache *groupcache.Group
+	index          bleve.Index
+	indexTemp      string
+	synonyms       synonyms
+	analytics      *analytics.Recorder
+	authenticator  auth.AuthenticatorInterface
+
+	// mbtiles are the prerendered tiles, which have a single scale and format.
+	mbtiles       *mbtiles.Tiles
+	mbtilesScale  int
+	mbtilesFormat string
+
+	// mu guards the state derived from the buildings.
+	mu      sync.RWMutex
+	graph   *models.Graph
+	idIndex map[string]*models.Index
+	// indexed is the version of each building in the search index.
+	indexed map[string]*models.Building
 
 	mapTileReq chan *MapTileRequest
 }
@@ -62,30 +96,64 @@ func NewServer() (*Server, error) {
 		log.Println("Warning: no google api key; OCR impossible")
 	}
 
+	models.HistoryPath = *historyPath
+
 	s := &Server{}
 
 	s.authenticator = auth.NewBasicAuthenticator("localhost", s.secret)
 
 	s.r = mux.NewRouter()
-	s.r.HandleFunc("/api/tiles/{zoom}_{x}_{y}_{floor}.png", s.tiles)
+	s.r.HandleFunc("/api/tiles/{zoom}_{x}_{y}_{floor:[^/@]+}@{scale:[0-9]+}x.png", s.tiles)
+	s.r.HandleFunc("/api/tiles/{zoom}_{x}_{y}_{floor:[^/@]+}.png", s.tiles)
+	s.r.HandleFunc("/api/vtiles/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.pbf", s.vectorTiles)
 	s.r.HandleFunc("/api/view/{json}", s.view)
 	s.r.HandleFunc("/api/schedule/{loc}", s.schedule)
 	s.r.HandleFunc("/api/search/", s.search)
+	s.r.HandleFunc("/api/nearest/{type}", s.nearest)
 	s.r.HandleFunc("/api/item/{json}", s.item)
+	s.r.HandleFunc("/api/route/", s.route)
 	s.r.HandleFunc("/api/dump/", s.dump)
+	s.r.HandleFunc("/api/geojson/", s.geojson)
+	s.r.HandleFunc("/api/export/imdf.zip", s.exportIMDF)
 	s.r.HandleFunc("/api/save_building/", s.authenticator.Wrap(s.saveBuilding))
 	s.r.HandleFunc("/api/ocr/", s.authenticator.Wrap(s.ocrFloor))
+	s.r.HandleFunc("/api/import/geojson/", s.authenticator.Wrap(s.importGeoJSON))
+	s.r.HandleFunc("/api/history/{sis}", s.history)
+	s.r.HandleFunc("/api/diff/{sis}/{from}/{to}", s.diff)
+	s.r.HandleFunc("/api/revert/{sis}/{rev}", s.authenticator.Wrap(s.revert))
+	s.r.HandleFunc("/api/admin/search-stats", s.authenticator.Wrap(s.searchStats))
 	s.r.PathPrefix("/").Handler(http.FileServer(http.Dir("./static/")))
 	http.Handle("/", s.r)
 
 	log.Println("Loading existing map data...")
-	buildings, err := models.LoadMapData()
+	store, err := models.LoadStore()
 	if err != nil {
 		return nil, err
 	}
-	s.buildings = buildings
+	s.store = store
+
+	synonyms, err := loadSynonyms(*synonymsPath)
+	if err != nil {
+		return nil, err
+	}
+	s.synonyms = synonyms
+
+	if len(*analyticsPath) > 0 {
+		recorder, err := analytics.Open(*analyticsPath)
+		if err != nil {
+			return nil, err
+		}
+		s.analytics = recorder
+	}
+
+	if len(*mbtilesPath) > 0 {
+		if err := s.openMBTiles(*mbtilesPath); err != nil {
+			return nil, err
+		}
+	}
 
 	s.indexBuildings()
+	s.buildingsChanged()
 
 	s.initCache()
 	s.initTileBuilding()
@@ -93,55 +161,132 @@ func NewServer() (*Server, error) {
 	return s, nil
 }
 
-func (s Server) secret(user, realm string) string {
+func (s *Server) secret(user, realm string) string {
 	if user == "admin" {
 		return *adminPassword
 	}
 	return ""
 }
 
-// indexBuildings builds the search index as well as a way to look items up by SIS/room number.
+// indexBuildings builds the search index as well as a way to look items up by
+// SIS/room number. An existing index that matches the map data is reused.
 func (s *Server) indexBuildings() {
 	s.idIndex = make(map[string]*models.Index)
-	dir, err := ioutil.TempDir("", "campus")
+	s.indexed = make(map[string]*models.Building)
+	hash, err := mapDataHash()
 	if err != nil {
 		log.Fatal(err)
 	}
-	file := dir + "/index.bleve"
-	log.Printf("Index file %s", file)
-	mapping := bleve.NewIndexMapping()
-	index, err := bleve.New(file, mapping)
+	index, current, err := s.openIndex(hash)
 	if err != nil {
 		log.Fatal(err)
 	}
 	s.index = index
-	for _, b := range s.buildings {
+	var batch *bleve.Batch
+	if !current {
+		batch = index.NewBatch()
+		batch.SetInternal(mapHashKey, hash)
+	}
+	for _, b := range s.store.Buildings() {
+		s.indexBuilding(batch, b)
+	}
+	if batch == nil {
+		return
+	}
+	if err := index.Batch(batch); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// indexBuilding adds a building and its rooms to the batch and idIndex. A nil
+// batch only updates idIndex.
+func (s *Server) indexBuilding(batch *bleve.Batch, b *models.Building) {
+	idx := &models.Index{
+		Id:          b.SIS,
+		Name:        b.Name,
+		Type:        "building",
+		Description: b.Description,
+		SIS:         b.SIS,
+		Aliases:     b.Aliases,
+		Accessible:  true,
+		Location:    b.Position,
+	}
+	if batch != nil {
+		batch.Index(b.SIS, idx)
+	}
+	idx.Item = b.Meta()
+	idx.Image = b.Image
+	s.idIndex[b.SIS] = idx
+	for _, occupant := range b.Occupants {
+		id := departmentId(b, occupant)
 		idx := &models.Index{
-			Id:          b.SIS,
-			Name:        b.Name,
-			Type:        "building",
-			Description: b.Description,
+			Id:         id,
+			Name:       occupant,
+			Type:       "department",
+			SIS:        b.SIS,
+			Aliases:    append([]string{b.Name}, b.Aliases...),
+			Accessible: true,
+			Location:   b.Position,
+		}
+		if batch != nil {
+			batch.Index(id, idx)
 		}
-		index.Index(b.SIS, idx)
 		idx.Item = b.Meta()
-		idx.Image = b.Image
-		s.idIndex[b.SIS] = idx
-		for _, f := range b.Floors {
-			for _, r := range f.Rooms {
-				id := b.SIS + " " + r.Id
-				idx := &models.Index{
-					Id:   id,
-					Name: r.Name,
-					Type: r.Type,
-				}
-				index.Index(id, idx)
-				idx.Item = r
-				r.Floor = f.Name
-				r.SIS = b.SIS
-				s.idIndex[id] = idx
+		s.idIndex[id] = idx
+	}
+	for _, f := range b.Floors {
+		for _, r := range f.Rooms {
+			id := b.SIS + " " + r.Id
+			idx := &models.Index{
+				Id:         id,
+				Name:       r.Name,
+				Type:       r.Type,
+				SIS:        b.SIS,
+				Aliases:    append(append([]string{b.Name}, b.Aliases...), r.Aliases...),
+				Accessible: r.StepFree(),
+				Location:   r.Position,
+				Floor:      f.Name,
 			}
+			if batch != nil {
+				batch.Index(id, idx)
+			}
+			idx.Item = r
+			s.idIndex[id] = idx
+		}
+	}
+	s.indexed[b.SIS] = b
+}
+
+// departmentId returns the index id of a department in a building.
+func departmentId(b *models.Building, occupant string) string {
+	return b.SIS + " " + occupant
+}
+
+// unindexBuilding removes a building and its rooms from the batch and idIndex.
+func (s *Server) unindexBuilding(batch *bleve.Batch, b *models.Building) {
+	batch.Delete(b.SIS)
+	delete(s.idIndex, b.SIS)
+	for _, occupant := range b.Occupants {
+		id := departmentId(b, occupant)
+		batch.Delete(id)
+		delete(s.idIndex, id)
+	}
+	for _, f := range b.Floors {
+		for _, r := range f.Rooms {
+			id := b.SIS + " " + r.Id
+			batch.Delete(id)
+			delete(s.idIndex, id)
 		}
 	}
+	delete(s.indexed, b.SIS)
+}
+
+// lookup returns the indexed item with the id.
+func (s *Server) lookup(id string) (*models.Index, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	idx, ok := s.idIndex[id]
+	return idx, ok
 }
 
 func (s *Server) Listen() error {
@@ -151,7 +296,7 @@ func (s *Server) Listen() error {
 
 // GetBuildingFloor returns the specified floor from building and floor name.
 func (s *Server) GetBuildingFloor(b string, f string) *models.Floor {
-	for _, building := range s.buildings {
+	for _, building := range s.store.Buildings() {
 		if building.Name != b {
 			continue
 		}
@@ -168,7 +313,7 @@ func (s *Server) GetBuildingFloor(b string, f string) *models.Floor {
 func (s *Server) OverlappingBuildings(c *models.Coords) []*models.Building {
 	var buildings []*models.Building
 Building:
-	for _, building := range s.buildings {
+	for _, building := range s.store.Buildings() {
 		if c.OverlapLatLng(building.Position) {
 			buildings = append(buildings, building)
 			continue Building
@@ -196,46 +341,197 @@ func (s *Server) saveBuilding(w http.ResponseWriter, r *auth.AuthenticatedReques
 		http.Error(w, err.Error(), 400)
 		return
 	}
-	for i, b2 := range s.buildings {
-		if b2.SIS != b.SIS {
-			continue
+	for _, f := range b.Floors {
+		if err := georeference(f); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
 		}
-		for _, f := range b.Floors {
-			dx, dy := newDimentions(f.Coords.DLng(), f.Coords.DLat(), f.Rotation)
-			affine := graphics.I.Rotate(f.Rotation)
-			log.Printf("DX %f DY %f", dx, dy)
-			for _, r := range f.Rooms {
-				if r.RelPosition == nil {
-					continue
-				}
-				rotated := affine.Mul(graphics.Affine{
-					(r.RelPosition.Lng - 0.5) * f.Coords.DLng(), 0, 0,
-					(1 - r.RelPosition.Lat - 0.5) * f.Coords.DLat(), 0, 0,
-					1, 1, 1,
-				})
-				px := (rotated[0]/dx + 0.5)
-				py := (rotated[3]/dy + 0.5)
-
-				log.Printf("(%f, %f) -> (%f, %f)", r.RelPosition.Lng, r.RelPosition.Lat, px, py)
-
-				lat := (py)*f.Coords.DLat() + f.Coords.South
-				lng := (px)*f.Coords.DLng() + f.Coords.West
-				r.Position = &models.LatLng{
-					Lat: lat,
-					Lng: lng,
-				}
+		for _, r := range f.Rooms {
+			if r.RelPosition == nil {
+				continue
 			}
+			r.Position = f.RelToLatLng(r.RelPosition)
+		}
+	}
+	if _, err := s.store.Update(b, r.Username, nil); err != nil {
+		storeError(w, err)
+		return
+	}
+	s.buildingsChanged(b.SIS)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+// georeference fits the floor's transform to its control points and logs
+// how well it fits. The transform is cleared if there are no control points.
+func georeference(f *models.Floor) error {
+	if len(f.ControlPoints) == 0 {
+		f.Transform = nil
+		f.RMS = 0
+		return nil
+	}
+	width, height, err := f.ImageSize()
+	if err != nil {
+		return err
+	}
+	rms, err := f.Georeference(width, height)
+	if err != nil {
+		return fmt.Errorf("floor %s: %s", f.Name, err)
+	}
+	log.Printf("Georeferenced floor %s with %d control points; RMS error %.2fm", f.Name, len(f.ControlPoints), rms)
+	return nil
+}
+
+// storeError responds with the status matching an error from the store.
+func storeError(w http.ResponseWriter, err error) {
+	switch err {
+	case models.ErrNotFound:
+		http.Error(w, err.Error(), 404)
+	case models.ErrConflict:
+		http.Error(w, err.Error(), 409)
+	default:
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+// buildingsChanged updates the state derived from the buildings after the
+// buildings with the SIS have been modified. The changed buildings are
+// reindexed and their rendered tiles removed in the background.
+func (s *Server) buildingsChanged(changed ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.graph = models.NewGraph(s.store.Buildings())
+
+	if len(changed) == 0 {
+		return
+	}
+	batch := s.index.NewBatch()
+	var stale []tileRange
+	for _, sis := range changed {
+		if prev := s.indexed[sis]; prev != nil {
+			s.unindexBuilding(batch, prev)
+			stale = append(stale, floorTileRanges(prev)...)
+		}
+		if b := s.store.Building(sis); b != nil {
+			s.indexBuilding(batch, b)
+			stale = append(stale, floorTileRanges(b)...)
 		}
-		s.buildings[i] = b
-		if err := models.SaveMapData(s.buildings); err != nil {
+	}
+	go s.removeTiles(stale)
+	if hash, err := mapDataHash(); err == nil {
+		batch.SetInternal(mapHashKey, hash)
+	} else {
+		log.Printf("Failed to hash map data: %s", err)
+	}
+	if err := s.index.Batch(batch); err != nil {
+		log.Printf("Failed to reindex %v: %s", changed, err)
+	}
+}
+
+// history returns the revisions of a building.
+func (s *Server) history(w http.ResponseWriter, r *http.Request) {
+	sis := mux.Vars(r)["sis"]
+	revs, err := models.Revisions(sis)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revs)
+}
+
+// loadRevision loads the revision of the building named by the request vars.
+func loadRevision(vars map[string]string, key string) (*models.Revision, error) {
+	rev, err := strconv.Atoi(vars[key])
+	if err != nil {
+		return nil, err
+	}
+	return models.LoadRevision(vars["sis"], rev)
+}
+
+// diff returns the differences between two revisions of a building.
+func (s *Server) diff(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	from, err := loadRevision(vars, "from")
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	to, err := loadRevision(vars, "to")
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.DiffBuildings(from.Building, to.Building))
+}
+
+// revert restores a building to an earlier revision, recording it as a new
+// revision.
+func (s *Server) revert(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	if r.Method != "POST" {
+		http.Error(w, "revert must be a POST", 405)
+		return
+	}
+	rev, err := loadRevision(mux.Vars(&r.Request), "rev")
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	current := s.store.Building(rev.SIS)
+	if current == nil {
+		http.Error(w, models.ErrNotFound.Error(), 404)
+		return
+	}
+	b := rev.Building
+	b.Version = current.Version
+	if _, err := s.store.Update(b, r.Username, &rev.Rev); err != nil {
+		storeError(w, err)
+		return
+	}
+	s.buildingsChanged(b.SIS)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+// importGeoJSON merges the floors and rooms from a GeoJSON FeatureCollection.
+// With dry_run set, the changes are returned without being saved.
+func (s *Server) importGeoJSON(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	fc := &geojson.FeatureCollection{}
+	if err := json.NewDecoder(r.Body).Decode(fc); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	changes, err := geojson.Merge(s.store.Buildings(), fc, true)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if !dryRun {
+		var changed []string
+		for _, c := range changes {
+			changed = append(changed, c.SIS)
+		}
+		// The buildings can change between the dry run and the edit, so the
+		// merge can still fail on invalid features.
+		var mergeErr error
+		err := s.store.Edit(r.Username, func(buildings []*models.Building) ([]string, error) {
+			_, mergeErr = geojson.Merge(buildings, fc, false)
+			return changed, mergeErr
+		})
+		if mergeErr != nil {
+			http.Error(w, mergeErr.Error(), 400)
+			return
+		}
+		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(s.buildings[i])
-		return
+		s.buildingsChanged(changed...)
 	}
-	http.Error(w, "building SIS not found", 404)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
 }
 
 // ocrFloor runs google OCR on the floor image for text analysis.
@@ -296,16 +592,72 @@ func (s *Server) item(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	args := vars["json"]
 
-	results, ok := s.idIndex[args]
+	results, ok := s.lookup(args)
 	if !ok {
 		http.Error(w, "item not found", 404)
 		return
 	}
+	s.record(func(a *analytics.Recorder) error {
+		return a.Click(results.Id)
+	})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(results.Item)
 }
 
+// routeVertex returns the routing graph key for an item.
+func (s *Server) routeVertex(id string) (string, bool) {
+	idx, ok := s.lookup(id)
+	if !ok {
+		return "", false
+	}
+	switch item := idx.Item.(type) {
+	case *models.Room:
+		return models.RoomVertex(item.SIS, item.Floor, item.Id), true
+	case *models.Building:
+		return models.BuildingVertex(item.SIS), true
+	}
+	return "", false
+}
+
+// route returns the walking route between two items. The accessible profile
+// only uses step-free paths.
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	profile := query.Get("profile")
+	if profile != "" && profile != models.ProfileAccessible {
+		http.Error(w, "unknown profile", 400)
+		return
+	}
+
+	from, ok := s.routeVertex(query.Get("from"))
+	if !ok {
+		http.Error(w, "from item not found", 404)
+		return
+	}
+	to, ok := s.routeVertex(query.Get("to"))
+	if !ok {
+		http.Error(w, "to item not found", 404)
+		return
+	}
+
+	s.mu.RLock()
+	graph := s.graph
+	s.mu.RUnlock()
+	route, err := graph.Route(from, to, profile)
+	if err == models.ErrNoRoute || err == models.ErrNoStepFreeRoute {
+		http.Error(w, err.Error(), 404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(route)
+}
+
 // schedule returns the schedule for a UBC food services location.
 func (s *Server) schedule(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -326,45 +678,304 @@ func (s *Server) schedule(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(schedule))
 }
 
-// search executes a search for rooms or buildings.
+// maxSearchSize is the most results a search can return at once.
+const maxSearchSize = 100
+
+// maxSearchFrom is the furthest into the results a search can page.
+const maxSearchFrom = 1000
+
+// searchFacets are the fields search results are counted by.
+var searchFacets = []string{"Type", "SIS", "Floor"}
+
+// highlightFields are the fields matches are highlighted in.
+var highlightFields = []string{"Id", "Name", "Description"}
+
+type FacetCount struct {
+	Term  string
+	Count int
+}
+
+// SearchHit is a search result with the highlighted fragments of its Id, Name
+// and Description that matched, and optionally how its score was computed.
+type SearchHit struct {
+	*models.Index
+	Fragments   map[string][]string `json:",omitempty"`
+	Explanation *search.Explanation `json:",omitempty"`
+}
+
+type SearchResp struct {
+	Total  uint64
+	From   int
+	Size   int
+	Hits   []*SearchHit
+	Facets map[string][]FacetCount
+}
+
+// intParam returns the integer query parameter, or def if it's missing.
+func intParam(query url.Values, name string, def int) (int, error) {
+	v := query.Get(name)
+	if len(v) == 0 {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return i, nil
+}
+
+// countFacets adds an item that didn't come from the search index, such as an
+// exact match, to the facet counts.
+func countFacets(facets map[string][]FacetCount, idx *models.Index) {
+	terms := map[string]string{"Type": idx.Type, "SIS": idx.SIS, "Floor": idx.Floor}
+	for _, name := range searchFacets {
+		term := terms[name]
+		if len(term) == 0 {
+			continue
+		}
+		counts := facets[name]
+		found := false
+		for i := range counts {
+			if counts[i].Term == term {
+				counts[i].Count++
+				found = true
+			}
+		}
+		if !found {
+			counts = append(counts, FacetCount{Term: term, Count: 1})
+		}
+		sort.SliceStable(counts, func(i, j int) bool {
+			return counts[i].Count > counts[j].Count
+		})
+		facets[name] = counts
+	}
+}
+
+// searchTypes returns the types from the type parameters, which may also be
+// comma separated. It returns nil if there are no types or they include "all".
+func searchTypes(params []string) map[string]bool {
+	var types map[string]bool
+	for _, v := range params {
+		for _, typ := range strings.Split(v, ",") {
+			if typ == "all" {
+				return nil
+			}
+			if types == nil {
+				types = make(map[string]bool)
+			}
+			types[typ] = true
+		}
+	}
+	return types
+}
+
+// typeQuery matches items of any of the types.
+func typeQuery(types map[string]bool) query.Query {
+	var queries []query.Query
+	for typ := range types {
+		termQuery := bleve.NewTermQuery(typ)
+		termQuery.SetField("Type")
+		queries = append(queries, termQuery)
+	}
+	return bleve.NewDisjunctionQuery(queries...)
+}
+
+// search executes a search for rooms or buildings and returns a page of the
+// results along with counts by type, building and floor. Given a lat and lng
+// the results are sorted by distance. With explain=true each result includes
+// its scoring explanation. Only exact searches and ones the client marks with
+// submit=true are recorded in the analytics, so autocomplete requests for each
+// keystroke aren't.
 func (s *Server) search(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 
 	q := query.Get("q")
-	typeFilter := query.Get("type")
+	accessible := query.Get("profile") == models.ProfileAccessible
+	mode := query.Get("mode")
+	if len(mode) == 0 {
+		mode = modePrefix
+	}
+	o, err := parseOrigin(query)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	from, err := intParam(query, "from", 0)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	size, err := intParam(query, "size", 25)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if size > maxSearchSize {
+		size = maxSearchSize
+	}
+	if from > maxSearchFrom {
+		from = maxSearchFrom
+	}
 
-	results := []*models.Index{}
-	if idx, ok := s.idIndex[q]; ok {
-		results = append(results, idx)
-	} else {
+	resp := &SearchResp{
+		From:   from,
+		Size:   size,
+		Hits:   []*SearchHit{},
+		Facets: make(map[string][]FacetCount),
+	}
+
+	// Exact id matches are always ranked first.
+	types := searchTypes(query["type"])
+	exact, ok := s.lookupExact(q)
+	if !ok || (accessible && !exact.Accessible) || (types != nil && !types[exact.Type]) {
+		exact = nil
+	}
+	if exact != nil {
+		resp.Total++
+		if from > 0 {
+			from--
+		} else if size > 0 {
+			resp.Hits = append(resp.Hits, &SearchHit{Index: exact})
+			size--
+		}
+	}
+	if exact == nil || mode != modeExact {
 		query := bleve.NewBooleanQuery()
 		if len(q) > 0 {
-			/*fuzzy_query := bleve.NewFuzzyQuery(q)
-			fuzzy_query.FuzzinessVal = 3
-			queryShould = append(queryShould, fuzzy_query)
-			queryShould = append(queryShould, bleve.NewRegexpQuery("[a-zA-Z0-9_]*"+q+"[a-zA-Z0-9_]*"))
-			queryShould = append(queryShould, bleve.NewQueryStringQuery(q))*/
-			query.AddShould(bleve.NewQueryStringQuery(q))
+			textQuery, err := s.searchQuery(q, mode)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			query.AddShould(textQuery)
+		}
+
+		if types != nil {
+			query.AddMust(typeQuery(types))
+		}
+
+		if accessible {
+			accessibleQuery := bleve.NewBoolFieldQuery(true)
+			accessibleQuery.SetField("Accessible")
+			query.AddMust(accessibleQuery)
 		}
 
-		if typeFilter != "all" {
-			termQuery := bleve.NewTermQuery(typeFilter)
-			query.AddMust(termQuery)
+		if exact != nil {
+			query.AddMustNot(bleve.NewDocIDQuery([]string{exact.Id}))
 		}
 
-		searchRequest := bleve.NewSearchRequest(query)
-		searchRequest.Size = 25
-		searchResult, err := s.index.Search(searchRequest)
+		req := bleve.NewSearchRequest(query)
+		req.Explain = r.URL.Query().Get("explain") == "true"
+		req.Highlight = bleve.NewHighlightWithStyle(html.Name)
+		for _, field := range highlightFields {
+			req.Highlight.AddField(field)
+		}
+		for _, field := range searchFacets {
+			req.AddFacet(field, bleve.NewFacetRequest(field, 50))
+		}
+		items, result, err := s.searchIndex(req, o, from, size)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		resp.Hits = append(resp.Hits, items...)
+		resp.Total += result.Total
+		for name, facet := range result.Facets {
+			counts := []FacetCount{}
+			for _, term := range facet.Terms {
+				if len(term.Term) == 0 {
+					continue
+				}
+				counts = append(counts, FacetCount{Term: term.Term, Count: term.Count})
+			}
+			resp.Facets[name] = counts
+		}
+	}
+	if exact != nil {
+		countFacets(resp.Facets, exact)
+	}
 
-		for _, result := range []*search.DocumentMatch(searchResult.Hits) {
-			results = append(results, s.idIndex[result.ID])
+	if len(q) > 0 && (mode == modeExact || query.Get("submit") == "true") {
+		typ := strings.Join(query["type"], ",")
+		s.record(func(a *analytics.Recorder) error {
+			return a.Search(q, typ, resp.Total)
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// record records analytics in the background if they're enabled.
+func (s *Server) record(fn func(*analytics.Recorder) error) {
+	if s.analytics == nil {
+		return
+	}
+	s.analytics.Background(fn)
+}
+
+// searchStats returns the most common searches, searches without results and
+// clicked items.
+func (s *Server) searchStats(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	if s.analytics == nil {
+		http.Error(w, "analytics are disabled", 404)
+		return
+	}
+	n, err := intParam(r.URL.Query(), "n", 20)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	stats, err := s.analytics.Stats(n)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// nearest returns the closest items of a type to the lat, lng and floor.
+func (s *Server) nearest(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	o, err := parseOrigin(query)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if o == nil {
+		http.Error(w, "lat and lng are required", 400)
+		return
+	}
+	size := 5
+	if len(query.Get("size")) > 0 {
+		size, err = strconv.Atoi(query.Get("size"))
+		if err != nil || size <= 0 {
+			http.Error(w, "invalid size", 400)
+			return
 		}
 	}
+	if size > maxSearchSize {
+		size = maxSearchSize
+	}
 
+	typeQuery := bleve.NewTermQuery(mux.Vars(r)["type"])
+	typeQuery.SetField("Type")
+	q := bleve.NewBooleanQuery()
+	q.AddMust(typeQuery)
+	if query.Get("profile") == models.ProfileAccessible {
+		accessibleQuery := bleve.NewBoolFieldQuery(true)
+		accessibleQuery.SetField("Accessible")
+		q.AddMust(accessibleQuery)
+	}
+	results, _, err := s.searchIndex(bleve.NewSearchRequest(q), o, 0, size)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if results == nil {
+		results = []*SearchHit{}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(results)
 }
@@ -417,13 +1028,54 @@ func (s *Server) view(w http.ResponseWriter, r *http.Request) {
 // dump just dumps the entire database.
 func (s *Server) dump(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(s.buildings)
+	json.NewEncoder(w).Encode(s.store.Buildings())
+}
+
+// geojson returns the database as a GeoJSON FeatureCollection, optionally
+// filtered by building SIS and floor.
+func (s *Server) geojson(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := geojson.Filter{
+		SIS:   query.Get("sis"),
+		Floor: query.Get("floor"),
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	json.NewEncoder(w).Encode(geojson.FromBuildings(s.store.Buildings(), filter))
+}
+
+// exportIMDF returns the database as an IMDF archive.
+func (s *Server) exportIMDF(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := imdf.Write(&buf, s.store.Buildings(), *venueName); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Write(buf.Bytes())
 }
 
 func main() {
+	flag.Parse()
+	if cmd, ok := commands[flag.Arg(0)]; ok {
+		if err := cmd(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	s, err := NewServer()
 	if err != nil {
 		log.Fatal(err)
 	}
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+		log.Println("Shutting down...")
+		if err := s.Close(); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}()
 	log.Fatal(s.Listen())
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/abbot/go-http-auth"
+	"github.com/d4l3k/campus/models"
+	"github.com/gorilla/mux"
+)
+
+// useTempStore points testServer at a copy of the bundled map data with an
+// empty history, so handlers can edit it. It returns a function restoring the
+// bundled store.
+func useTempStore(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "campus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(models.MapDataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapDataPath, historyPath, store := models.MapDataPath, models.HistoryPath, testServer.store
+	models.MapDataPath = filepath.Join(dir, "map.json")
+	models.HistoryPath = filepath.Join(dir, "history")
+	if err := ioutil.WriteFile(models.MapDataPath, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if testServer.store, err = models.LoadStore(); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		var changed []string
+		for _, b := range testServer.store.Buildings() {
+			changed = append(changed, b.SIS)
+		}
+		models.MapDataPath, models.HistoryPath, testServer.store = mapDataPath, historyPath, store
+		testServer.buildingsChanged(changed...)
+		os.RemoveAll(dir)
+	}
+}
+
+// adminRequest returns an authenticated request with the mux vars set.
+func adminRequest(method, target string, body io.Reader, vars map[string]string) *auth.AuthenticatedRequest {
+	r := mux.SetURLVars(httptest.NewRequest(method, target, body), vars)
+	return &auth.AuthenticatedRequest{Request: *r, Username: "admin"}
+}
+
+func TestRevert(t *testing.T) {
+	defer useTempStore(t)()
+
+	original := testServer.store.Building("ICCS")
+	edited := original.Clone()
+	edited.Name = "Renamed"
+	if _, err := testServer.store.Update(edited, "alice", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	testServer.revert(w, adminRequest("GET", "/api/revert/ICCS/0", nil, map[string]string{"sis": "ICCS", "rev": "0"}))
+	if w.Code != 405 {
+		t.Errorf("GET revert: got status %d, want 405", w.Code)
+	}
+	w = httptest.NewRecorder()
+	testServer.revert(w, adminRequest("POST", "/api/revert/ICCS/9", nil, map[string]string{"sis": "ICCS", "rev": "9"}))
+	if w.Code != 404 {
+		t.Errorf("revert to a missing revision: got status %d, want 404", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	testServer.revert(w, adminRequest("POST", "/api/revert/ICCS/0", nil, map[string]string{"sis": "ICCS", "rev": "0"}))
+	if w.Code != 200 {
+		t.Fatalf("revert: got status %d: %s", w.Code, w.Body.String())
+	}
+	b := testServer.store.Building("ICCS")
+	if b.Name != original.Name || b.Version != original.Version+2 {
+		t.Errorf("got building %q version %d, want %q version %d", b.Name, b.Version, original.Name, original.Version+2)
+	}
+	revs, err := models.Revisions("ICCS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 3 {
+		t.Fatalf("got %d revisions, want 3", len(revs))
+	}
+	if r := revs[2]; r.Author != "admin" || r.RevertOf == nil || *r.RevertOf != 0 {
+		t.Errorf("got revision %d by %q reverting %v, want admin reverting 0", r.Rev, r.Author, r.RevertOf)
+	}
+	if diffs := models.DiffBuildings(original, b); len(diffs) != 0 {
+		for _, d := range diffs {
+			t.Errorf("reverted building differs from the original: %+v", d)
+		}
+	}
+}
+
+func TestSaveBuildingConflict(t *testing.T) {
+	defer useTempStore(t)()
+
+	save := func(b *models.Building) *httptest.ResponseRecorder {
+		buf, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		testServer.saveBuilding(w, adminRequest("POST", "/api/save_building/", bytes.NewReader(buf), nil))
+		return w
+	}
+	loaded := testServer.store.Building("ICCS")
+	first := loaded.Clone()
+	first.Name = "First"
+	if w := save(first); w.Code != 200 {
+		t.Fatalf("save: got status %d: %s", w.Code, w.Body.String())
+	}
+	// A second editor saving the version they loaded conflicts with the first.
+	second := loaded.Clone()
+	second.Name = "Second"
+	if w := save(second); w.Code != 409 {
+		t.Errorf("conflicting save: got status %d, want 409", w.Code)
+	}
+	if b := testServer.store.Building("ICCS"); b.Name != "First" || b.Version != loaded.Version+1 {
+		t.Errorf("got building %q version %d, want the first save", b.Name, b.Version)
+	}
+}
@@ -0,0 +1,155 @@
+// Package mbtiles stores rendered map tiles in an MBTiles SQLite database.
+// Since every floor has its own tiles, the tiles table has an extra floor
+// column alongside the standard ones.
+package mbtiles
+
+import (
+	"database/sql"
+	"strconv"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS metadata (name TEXT PRIMARY KEY, value TEXT);
+CREATE TABLE IF NOT EXISTS tiles (
+	zoom_level INTEGER,
+	tile_column INTEGER,
+	tile_row INTEGER,
+	floor TEXT,
+	tile_data BLOB
+);
+CREATE UNIQUE INDEX IF NOT EXISTS tile_index ON tiles (zoom_level, tile_column, tile_row, floor);
+`
+
+// Tile is a rendered tile. Y is in the XYZ scheme the server uses; it's
+// flipped to the TMS scheme MBTiles uses when stored.
+type Tile struct {
+	Z, X, Y int
+	Floor   string
+	Data    []byte
+}
+
+// Tiles is an MBTiles database.
+type Tiles struct {
+	db *sql.DB
+}
+
+// Open opens or creates the MBTiles database at path.
+func Open(path string) (*Tiles, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer at a time.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Tiles{db: db}, nil
+}
+
+// Close closes the database.
+func (t *Tiles) Close() error {
+	return t.db.Close()
+}
+
+// tmsRow converts an XYZ tile row to a TMS one.
+func tmsRow(z, y int) int {
+	return 1<<uint(z) - 1 - y
+}
+
+// Get returns the data of a tile, or nil if it hasn't been rendered.
+func (t *Tiles) Get(z, x, y int, floor string) ([]byte, error) {
+	var data []byte
+	err := t.db.QueryRow(
+		"SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ? AND floor = ?",
+		z, x, tmsRow(z, y), floor,
+	).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Has returns whether a tile has been rendered.
+func (t *Tiles) Has(z, x, y int, floor string) (bool, error) {
+	var n int
+	err := t.db.QueryRow(
+		"SELECT COUNT(*) FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ? AND floor = ?",
+		z, x, tmsRow(z, y), floor,
+	).Scan(&n)
+	return n > 0, err
+}
+
+// Put stores the tiles in a single transaction, replacing any existing ones.
+func (t *Tiles) Put(tiles ...*Tile) error {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, floor, tile_data) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, tile := range tiles {
+		if _, err := stmt.Exec(tile.Z, tile.X, tmsRow(tile.Z, tile.Y), tile.Floor, tile.Data); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteRange removes the tiles from minX to maxX and minY to maxY at zoom
+// level z, along with the tiles covering them at lower zoom levels, in a single
+// transaction.
+func (t *Tiles) DeleteRange(z, minX, maxX, minY, maxY int, floor string) error {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("DELETE FROM tiles WHERE zoom_level = ? AND tile_column BETWEEN ? AND ? AND tile_row BETWEEN ? AND ? AND floor = ?")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for ; z >= 0; z-- {
+		// Rows are flipped in the TMS scheme, so maxY has the lowest row.
+		if _, err := stmt.Exec(z, minX, maxX, tmsRow(z, maxY), tmsRow(z, minY), floor); err != nil {
+			tx.Rollback()
+			return err
+		}
+		minX, maxX, minY, maxY = minX/2, maxX/2, minY/2, maxY/2
+	}
+	return tx.Commit()
+}
+
+// Metadata returns the metadata value of name, or "" if it isn't set.
+func (t *Tiles) Metadata(name string) (string, error) {
+	var value string
+	err := t.db.QueryRow("SELECT value FROM metadata WHERE name = ?", name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+// SetMetadata sets the metadata value of name.
+func (t *Tiles) SetMetadata(name, value string) error {
+	_, err := t.db.Exec("INSERT OR REPLACE INTO metadata (name, value) VALUES (?, ?)", name, value)
+	return err
+}
+
+// Scale returns the tile scale stored in the metadata, defaulting to 1.
+func (t *Tiles) Scale() (int, error) {
+	value, err := t.Metadata("scale")
+	if err != nil || len(value) == 0 {
+		return 1, err
+	}
+	return strconv.Atoi(value)
+}
@@ -0,0 +1,57 @@
+package mbtiles
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeleteRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbtiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tiles, err := Open(filepath.Join(dir, "tiles.mbtiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tiles.Close()
+
+	var all []*Tile
+	for z := 0; z <= 3; z++ {
+		for x := 0; x < 1<<uint(z); x++ {
+			for y := 0; y < 1<<uint(z); y++ {
+				for _, floor := range []string{"1", "2"} {
+					all = append(all, &Tile{Z: z, X: x, Y: y, Floor: floor, Data: []byte{1}})
+				}
+			}
+		}
+	}
+	if err := tiles.Put(all...); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tiles 2-3 by 4-5 at zoom 3 are covered by tile 1, 2 at zoom 2, 0, 1 at
+	// zoom 1 and 0, 0 at zoom 0.
+	if err := tiles.DeleteRange(3, 2, 3, 4, 5, "1"); err != nil {
+		t.Fatal(err)
+	}
+	deleted := func(tile *Tile) bool {
+		if tile.Floor != "1" {
+			return false
+		}
+		shift := uint(3 - tile.Z)
+		return tile.X >= 2>>shift && tile.X <= 3>>shift && tile.Y >= 4>>shift && tile.Y <= 5>>shift
+	}
+	for _, tile := range all {
+		has, err := tiles.Has(tile.Z, tile.X, tile.Y, tile.Floor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if has == deleted(tile) {
+			t.Errorf("tile %d/%d/%d floor %s: got exists %t", tile.Z, tile.X, tile.Y, tile.Floor, has)
+		}
+	}
+}
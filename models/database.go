@@ -3,6 +3,8 @@ package models
 import (
 	"encoding/json"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sort"
 )
 
@@ -21,12 +23,31 @@ func LoadMapData() ([]*Building, error) {
 	return buildings, nil
 }
 
-func SaveMapData(buildings []*Building) error {
+// saveMapData writes the buildings to a temporary file and renames it over the
+// map data so readers never see a partially written file. Only the Store
+// saves the map data, so every change is recorded in the history.
+func saveMapData(buildings []*Building) error {
 	buf, err := json.MarshalIndent(buildings, "", "  ")
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(MapDataPath, buf, 0755)
+	f, err := ioutil.TempFile(filepath.Dir(MapDataPath), ".map.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), MapDataPath)
 }
 
 type BySIS []*Building
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"errors"
+	"image"
+	"math"
+	"os"
+)
+
+// ErrTooFewControlPoints is returned when fitting a floor with fewer than
+// three control points.
+var ErrTooFewControlPoints = errors.New("at least 3 control points are needed to georeference a floor")
+
+// ErrDegenerateControlPoints is returned when the control points are all in
+// a line, so they don't determine a transform.
+var ErrDegenerateControlPoints = errors.New("control points must not all be in a line")
+
+// ControlPoint ties a pixel of the floor image to where it is on the map.
+type ControlPoint struct {
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	Position *LatLng `json:"position"`
+	// Residual is how far in metres the fitted transform places the pixel
+	// from Position.
+	Residual float64 `json:"residual,omitempty"`
+}
+
+// Affine maps a position relative to the floor image, with the origin in the
+// top left, to a LatLng:
+//
+//	Lng = A*rel.Lng + B*rel.Lat + C
+//	Lat = D*rel.Lng + E*rel.Lat + F
+type Affine struct {
+	A float64 `json:"a"`
+	B float64 `json:"b"`
+	C float64 `json:"c"`
+	D float64 `json:"d"`
+	E float64 `json:"e"`
+	F float64 `json:"f"`
+}
+
+// Apply transforms a position relative to the floor image to a LatLng.
+func (t *Affine) Apply(rel *LatLng) *LatLng {
+	return &LatLng{
+		Lng: t.A*rel.Lng + t.B*rel.Lat + t.C,
+		Lat: t.D*rel.Lng + t.E*rel.Lat + t.F,
+	}
+}
+
+// FitAffine returns the least squares affine transform from the relative
+// positions to the LatLngs.
+func FitAffine(rels, positions []*LatLng) (*Affine, error) {
+	if len(rels) < 3 {
+		return nil, ErrTooFewControlPoints
+	}
+	// Solve the normal equations, which share the matrix for both outputs.
+	var m [3][3]float64
+	var lng, lat [3]float64
+	for i, rel := range rels {
+		row := [3]float64{rel.Lng, rel.Lat, 1}
+		for j := range row {
+			for k := range row {
+				m[j][k] += row[j] * row[k]
+			}
+			lng[j] += row[j] * positions[i].Lng
+			lat[j] += row[j] * positions[i].Lat
+		}
+	}
+	x, ok := solve3(m, lng)
+	if !ok {
+		return nil, ErrDegenerateControlPoints
+	}
+	y, _ := solve3(m, lat)
+	return &Affine{A: x[0], B: x[1], C: x[2], D: y[0], E: y[1], F: y[2]}, nil
+}
+
+// solve3 solves m*x = v by Cramer's rule. It returns false if m is singular.
+func solve3(m [3][3]float64, v [3]float64) ([3]float64, bool) {
+	det := func(m [3][3]float64) float64 {
+		return m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+			m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+			m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	}
+	d := det(m)
+	// The relative positions are within about [0, 1], so the determinant is
+	// only tiny if the points are in a line.
+	if math.Abs(d) < 1e-12 {
+		return [3]float64{}, false
+	}
+	var x [3]float64
+	for i := range x {
+		mi := m
+		for j := range mi {
+			mi[j][i] = v[j]
+		}
+		x[i] = det(mi) / d
+	}
+	return x, true
+}
+
+// ImageSize returns the size of the floor image in pixels, or in user units
+// for vector floor plans. Only the header of the image is read.
+func (f *Floor) ImageSize() (float64, float64, error) {
+	file, err := os.Open("static/" + f.Image)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	if f.IsSVG() {
+		return svgSize(file)
+	}
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	return float64(config.Width), float64(config.Height), nil
+}
+
+// Georeference fits the floor's transform to its control points on an image
+// that is w by h, records the residual of each control point and updates the
+// coords to contain the transformed image. It returns the root mean square
+// residual in metres, which is also stored in RMS. Floors without control
+// points fall back to their coords and rotation.
+func (f *Floor) Georeference(w, h float64) (float64, error) {
+	if len(f.ControlPoints) == 0 {
+		f.Transform = nil
+		f.RMS = 0
+		return 0, nil
+	}
+	rels := make([]*LatLng, len(f.ControlPoints))
+	positions := make([]*LatLng, len(f.ControlPoints))
+	for i, p := range f.ControlPoints {
+		if p.Position == nil {
+			return 0, errors.New("control point has no position")
+		}
+		rels[i] = &LatLng{Lat: p.Y / h, Lng: p.X / w}
+		positions[i] = p.Position
+	}
+	t, err := FitAffine(rels, positions)
+	if err != nil {
+		return 0, err
+	}
+	f.Transform = t
+
+	var sum float64
+	for i, p := range f.ControlPoints {
+		p.Residual = t.Apply(rels[i]).Distance(p.Position)
+		sum += p.Residual * p.Residual
+	}
+
+	coords := &Coords{North: math.Inf(-1), South: math.Inf(1), East: math.Inf(-1), West: math.Inf(1)}
+	for _, p := range f.Footprint() {
+		coords.North = math.Max(coords.North, p.Lat)
+		coords.South = math.Min(coords.South, p.Lat)
+		coords.East = math.Max(coords.East, p.Lng)
+		coords.West = math.Min(coords.West, p.Lng)
+	}
+	f.Coords = coords
+	f.RMS = math.Sqrt(sum / float64(len(f.ControlPoints)))
+	return f.RMS, nil
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFitAffine(t *testing.T) {
+	want := &Affine{A: 0.002, B: -0.0005, C: -123.25, D: 0.0003, E: -0.001, F: 49.26}
+	var rels, positions []*LatLng
+	for _, rel := range []*LatLng{{Lat: 0, Lng: 0}, {Lat: 0, Lng: 1}, {Lat: 1, Lng: 0}, {Lat: 1, Lng: 1}, {Lat: 0.3, Lng: 0.6}} {
+		rels = append(rels, rel)
+		positions = append(positions, want.Apply(rel))
+	}
+	got, err := FitAffine(rels, positions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := []float64{got.A, got.B, got.C, got.D, got.E, got.F}
+	w := []float64{want.A, want.B, want.C, want.D, want.E, want.F}
+	for i := range g {
+		if math.Abs(g[i]-w[i]) > 1e-9 {
+			t.Fatalf("got transform %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestFitAffineErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		rels []*LatLng
+		want error
+	}{
+		{"too few", []*LatLng{{Lat: 0, Lng: 0}, {Lat: 1, Lng: 1}}, ErrTooFewControlPoints},
+		{"collinear", []*LatLng{{Lat: 0, Lng: 0}, {Lat: 0.5, Lng: 0.5}, {Lat: 1, Lng: 1}}, ErrDegenerateControlPoints},
+		{"repeated", []*LatLng{{Lat: 0.2, Lng: 0.4}, {Lat: 0.2, Lng: 0.4}, {Lat: 0.2, Lng: 0.4}}, ErrDegenerateControlPoints},
+	}
+	for _, c := range cases {
+		positions := make([]*LatLng, len(c.rels))
+		for i := range positions {
+			positions[i] = &LatLng{Lat: 49.26 + float64(i)*0.0001, Lng: -123.25}
+		}
+		if _, err := FitAffine(c.rels, positions); err != c.want {
+			t.Errorf("%s: got error %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+func TestSolve3(t *testing.T) {
+	m := [3][3]float64{{2, 1, 0}, {1, 3, 1}, {0, 1, 4}}
+	want := [3]float64{1, -2, 3}
+	var v [3]float64
+	for i := range m {
+		for j := range m[i] {
+			v[i] += m[i][j] * want[j]
+		}
+	}
+	got, ok := solve3(m, v)
+	if !ok {
+		t.Fatal("solve3 reported a singular matrix")
+	}
+	for i := range got {
+		if math.Abs(got[i]-want[i]) > 1e-12 {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+
+	singular := [3][3]float64{{1, 2, 3}, {2, 4, 6}, {0, 1, 1}}
+	if _, ok := solve3(singular, v); ok {
+		t.Error("solve3 solved a singular matrix")
+	}
+}
@@ -0,0 +1,312 @@
+package models
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+)
+
+// Node types that make up a floor's walkable graph.
+const (
+	NodeCorridor = "corridor"
+	NodeDoor     = "door"
+	NodeStairs   = "stairs"
+	NodeElevator = "elevator"
+	NodeEntrance = "entrance"
+)
+
+// Extra cost in metres of changing floors by stairs or elevator.
+const (
+	StairsCost   = 10
+	ElevatorCost = 20
+)
+
+// EarthRadius is the mean radius of the earth in metres.
+const EarthRadius = 6371000
+
+// ProfileAccessible restricts routes to step-free nodes and rooms.
+const ProfileAccessible = "accessible"
+
+var (
+	ErrNoRoute         = errors.New("no route found")
+	ErrNoStepFreeRoute = errors.New("no step-free route found")
+)
+
+// Node is a point in a floor's walkable graph.
+type Node struct {
+	Id       string   `json:"id,omitempty"`
+	Type     string   `json:"type,omitempty"`
+	Position *LatLng  `json:"position,omitempty"`
+	Edges    []string `json:"edges,omitempty"`
+
+	// Room is the id of the room a door node opens into.
+	Room string `json:"room,omitempty"`
+	// Connector links stairs and elevator nodes on different floors of the
+	// same building that share the same value.
+	Connector string `json:"connector,omitempty"`
+	// Accessible overrides whether the node can be used without steps.
+	Accessible *bool `json:"accessible,omitempty"`
+}
+
+// StepFree returns whether the node can be used without steps.
+func (n Node) StepFree() bool {
+	return stepFree(n.Type, n.Accessible)
+}
+
+// stepFree returns whether something of the type is step-free. Stairs never
+// are and everything else is assumed to be unless marked otherwise.
+func stepFree(typ string, accessible *bool) bool {
+	if typ == NodeStairs {
+		return false
+	}
+	if accessible != nil {
+		return *accessible
+	}
+	return true
+}
+
+// Distance returns the great circle distance in metres between two points.
+func (p LatLng) Distance(p2 *LatLng) float64 {
+	lat1 := p.Lat * math.Pi / 180
+	lat2 := p2.Lat * math.Pi / 180
+	dLat := lat2 - lat1
+	dLng := (p2.Lng - p.Lng) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * EarthRadius * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// Waypoint is a single step along a route.
+type Waypoint struct {
+	Position *LatLng `json:"position,omitempty"`
+	SIS      string  `json:"sis,omitempty"`
+	Floor    string  `json:"floor,omitempty"`
+	Type     string  `json:"type,omitempty"`
+}
+
+// Route is an ordered list of waypoints between two locations.
+type Route struct {
+	Distance  float64     `json:"distance"`
+	Waypoints []*Waypoint `json:"waypoints"`
+}
+
+type vertex struct {
+	Waypoint
+	edges    []edge
+	stepFree bool
+}
+
+type edge struct {
+	to   *vertex
+	cost float64
+}
+
+// Graph is the walkable graph spanning every building's floors along with
+// outdoor links between buildings.
+type Graph struct {
+	vertices map[string]*vertex
+}
+
+// BuildingVertex returns the graph key for the outside of a building.
+func BuildingVertex(sis string) string {
+	return sis
+}
+
+// RoomVertex returns the graph key for a room.
+func RoomVertex(sis, floor, id string) string {
+	return sis + "/" + floor + "/room/" + id
+}
+
+func nodeVertex(sis, floor, id string) string {
+	return sis + "/" + floor + "/node/" + id
+}
+
+// NewGraph builds the walkable graph from the floor nodes of the buildings.
+// Rooms are connected through door nodes that open into them, or to the
+// nearest node on the floor if there is no such door. Rooms on floors without
+// any nodes are connected directly to the building.
+func NewGraph(buildings []*Building) *Graph {
+	g := &Graph{vertices: make(map[string]*vertex)}
+	var outside []*vertex
+	for _, b := range buildings {
+		if b.Position == nil {
+			continue
+		}
+		bv := g.add(BuildingVertex(b.SIS), Waypoint{Position: b.Position, SIS: b.SIS, Type: "building"}, true)
+		outside = append(outside, bv)
+
+		connectors := make(map[string][]*vertex)
+		for _, f := range b.Floors {
+			var nodes []*vertex
+			for _, n := range f.Nodes {
+				if n.Position == nil {
+					continue
+				}
+				v := g.add(nodeVertex(b.SIS, f.Name, n.Id), Waypoint{Position: n.Position, SIS: b.SIS, Floor: f.Name, Type: n.Type}, n.StepFree())
+				nodes = append(nodes, v)
+				if n.Type == NodeEntrance {
+					g.link(v, bv, v.Position.Distance(bv.Position))
+				}
+				if len(n.Connector) > 0 {
+					connectors[n.Connector] = append(connectors[n.Connector], v)
+				}
+			}
+			for _, n := range f.Nodes {
+				v := g.vertices[nodeVertex(b.SIS, f.Name, n.Id)]
+				if v == nil {
+					continue
+				}
+				for _, id := range n.Edges {
+					if v2 := g.vertices[nodeVertex(b.SIS, f.Name, id)]; v2 != nil {
+						g.link(v, v2, v.Position.Distance(v2.Position))
+					}
+				}
+			}
+			for _, r := range f.Rooms {
+				if r.Position == nil {
+					continue
+				}
+				rv := g.add(RoomVertex(b.SIS, f.Name, r.Id), Waypoint{Position: r.Position, SIS: b.SIS, Floor: f.Name, Type: "room"}, r.StepFree())
+				doors := 0
+				for _, n := range f.Nodes {
+					if n.Type != NodeDoor || n.Room != r.Id {
+						continue
+					}
+					if v := g.vertices[nodeVertex(b.SIS, f.Name, n.Id)]; v != nil {
+						g.link(rv, v, rv.Position.Distance(v.Position))
+						doors++
+					}
+				}
+				if doors > 0 {
+					continue
+				}
+				if nearest := nearestVertex(nodes, rv.Position); nearest != nil {
+					g.link(rv, nearest, rv.Position.Distance(nearest.Position))
+				} else {
+					g.link(rv, bv, rv.Position.Distance(bv.Position))
+				}
+			}
+		}
+		for _, vs := range connectors {
+			for i, v := range vs {
+				for _, v2 := range vs[i+1:] {
+					if v.Floor == v2.Floor {
+						continue
+					}
+					cost := float64(StairsCost)
+					if v.Type == NodeElevator {
+						cost = ElevatorCost
+					}
+					g.link(v, v2, cost)
+				}
+			}
+		}
+	}
+	for i, v := range outside {
+		for _, v2 := range outside[i+1:] {
+			g.link(v, v2, v.Position.Distance(v2.Position))
+		}
+	}
+	return g
+}
+
+func (g *Graph) add(key string, w Waypoint, stepFree bool) *vertex {
+	v := &vertex{Waypoint: w, stepFree: stepFree}
+	g.vertices[key] = v
+	return v
+}
+
+func (g *Graph) link(a, b *vertex, cost float64) {
+	a.edges = append(a.edges, edge{b, cost})
+	b.edges = append(b.edges, edge{a, cost})
+}
+
+func nearestVertex(vs []*vertex, p *LatLng) *vertex {
+	var nearest *vertex
+	best := math.Inf(1)
+	for _, v := range vs {
+		if d := p.Distance(v.Position); d < best {
+			best = d
+			nearest = v
+		}
+	}
+	return nearest
+}
+
+// Route finds the shortest route between the two vertex keys. With the
+// accessible profile, stairs and anything not step-free are avoided.
+func (g *Graph) Route(from, to, profile string) (*Route, error) {
+	start, end := g.vertices[from], g.vertices[to]
+	if start == nil || end == nil {
+		return nil, ErrNoRoute
+	}
+	accessible := profile == ProfileAccessible
+	if accessible && (!start.stepFree || !end.stepFree) {
+		return nil, ErrNoStepFreeRoute
+	}
+
+	dist := map[*vertex]float64{start: 0}
+	prev := make(map[*vertex]*vertex)
+	done := make(map[*vertex]bool)
+	q := &vertexQueue{{start, 0}}
+	for q.Len() > 0 {
+		item := heap.Pop(q).(vertexDist)
+		v := item.v
+		if done[v] {
+			continue
+		}
+		done[v] = true
+		if v == end {
+			break
+		}
+		for _, e := range v.edges {
+			if accessible && !e.to.stepFree {
+				continue
+			}
+			d := item.dist + e.cost
+			if cur, ok := dist[e.to]; ok && cur <= d {
+				continue
+			}
+			dist[e.to] = d
+			prev[e.to] = v
+			heap.Push(q, vertexDist{e.to, d})
+		}
+	}
+	if !done[end] {
+		if accessible {
+			return nil, ErrNoStepFreeRoute
+		}
+		return nil, ErrNoRoute
+	}
+
+	var path []*Waypoint
+	for v := end; v != nil; v = prev[v] {
+		w := v.Waypoint
+		path = append(path, &w)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return &Route{
+		Distance:  dist[end],
+		Waypoints: path,
+	}, nil
+}
+
+type vertexDist struct {
+	v    *vertex
+	dist float64
+}
+
+type vertexQueue []vertexDist
+
+func (q vertexQueue) Len() int            { return len(q) }
+func (q vertexQueue) Less(i, j int) bool  { return q[i].dist < q[j].dist }
+func (q vertexQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *vertexQueue) Push(x interface{}) { *q = append(*q, x.(vertexDist)) }
+func (q *vertexQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	x := old[n-1]
+	*q = old[:n-1]
+	return x
+}
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"testing"
+)
+
+// testBuilding returns a two floor building. Each floor has a corridor
+// running from the stairs and elevator to a door into a room, and the ground
+// floor has an entrance.
+func testBuilding() *Building {
+	pos := func(lat, lng float64) *LatLng {
+		return &LatLng{Lat: 49.26 + lat, Lng: -123.25 + lng}
+	}
+	no := false
+	return &Building{
+		SIS:      "TST",
+		Position: pos(0, -0.0005),
+		Floors: []*Floor{
+			{
+				Name: "1",
+				Nodes: []*Node{
+					{Id: "entrance", Type: NodeEntrance, Position: pos(0, -0.0002), Edges: []string{"hall"}},
+					{Id: "hall", Type: NodeCorridor, Position: pos(0, 0), Edges: []string{"stairs", "elevator", "door"}},
+					{Id: "stairs", Type: NodeStairs, Position: pos(0.0001, 0), Connector: "stairs"},
+					{Id: "elevator", Type: NodeElevator, Position: pos(-0.0001, 0), Connector: "elevator"},
+					{Id: "door", Type: NodeDoor, Position: pos(0, 0.0001), Room: "101"},
+				},
+				Rooms: []*Room{
+					{Id: "101", Position: pos(0, 0.0002)},
+				},
+			},
+			{
+				Name: "2",
+				Nodes: []*Node{
+					{Id: "hall", Type: NodeCorridor, Position: pos(0, 0), Edges: []string{"stairs", "elevator", "door"}},
+					{Id: "stairs", Type: NodeStairs, Position: pos(0.0001, 0), Connector: "stairs"},
+					{Id: "elevator", Type: NodeElevator, Position: pos(-0.0001, 0), Connector: "elevator"},
+					{Id: "door", Type: NodeDoor, Position: pos(0, 0.0001), Room: "201"},
+				},
+				Rooms: []*Room{
+					{Id: "201", Position: pos(0, 0.0002)},
+					{Id: "202", Position: pos(0, 0.0003), Accessible: &no},
+				},
+			},
+			{
+				// A floor without nodes, whose rooms connect to the building.
+				Name: "3",
+				Rooms: []*Room{
+					{Id: "301", Position: pos(0, 0)},
+				},
+			},
+		},
+	}
+}
+
+// routeTypes returns the types of the waypoints along the route.
+func routeTypes(r *Route) []string {
+	var types []string
+	for _, w := range r.Waypoints {
+		types = append(types, w.Type)
+	}
+	return types
+}
+
+func TestGraphRoute(t *testing.T) {
+	cases := []struct {
+		name     string
+		from, to string
+		profile  string
+		want     []string
+		err      error
+	}{
+		{
+			name: "same floor",
+			from: BuildingVertex("TST"),
+			to:   RoomVertex("TST", "1", "101"),
+			want: []string{"building", NodeEntrance, NodeCorridor, NodeDoor, "room"},
+		},
+		{
+			name: "stairs are cheaper",
+			from: RoomVertex("TST", "1", "101"),
+			to:   RoomVertex("TST", "2", "201"),
+			want: []string{"room", NodeDoor, NodeCorridor, NodeStairs, NodeStairs, NodeCorridor, NodeDoor, "room"},
+		},
+		{
+			name:    "accessible avoids stairs",
+			from:    RoomVertex("TST", "1", "101"),
+			to:      RoomVertex("TST", "2", "201"),
+			profile: ProfileAccessible,
+			want:    []string{"room", NodeDoor, NodeCorridor, NodeElevator, NodeElevator, NodeCorridor, NodeDoor, "room"},
+		},
+		{
+			name: "floor without nodes",
+			from: RoomVertex("TST", "1", "101"),
+			to:   RoomVertex("TST", "3", "301"),
+			want: []string{"room", NodeDoor, NodeCorridor, NodeEntrance, "building", "room"},
+		},
+		{
+			name:    "accessible to a room with steps",
+			from:    RoomVertex("TST", "1", "101"),
+			to:      RoomVertex("TST", "2", "202"),
+			profile: ProfileAccessible,
+			err:     ErrNoStepFreeRoute,
+		},
+		{
+			name: "unknown room",
+			from: RoomVertex("TST", "1", "101"),
+			to:   RoomVertex("TST", "1", "999"),
+			err:  ErrNoRoute,
+		},
+	}
+	g := NewGraph([]*Building{testBuilding()})
+	for _, c := range cases {
+		route, err := g.Route(c.from, c.to, c.profile)
+		if err != c.err {
+			t.Errorf("%s: got error %v, want %v", c.name, err, c.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		got := routeTypes(route)
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got route %v, want %v", c.name, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: got route %v, want %v", c.name, got, c.want)
+				break
+			}
+		}
+		if route.Distance <= 0 {
+			t.Errorf("%s: got distance %f", c.name, route.Distance)
+		}
+	}
+}
+
+func TestGraphRouteAccessibleElevatorOutOfService(t *testing.T) {
+	b := testBuilding()
+	no := false
+	for _, f := range b.Floors {
+		for _, n := range f.Nodes {
+			if n.Type == NodeElevator {
+				n.Accessible = &no
+			}
+		}
+	}
+	g := NewGraph([]*Building{b})
+	from, to := RoomVertex("TST", "1", "101"), RoomVertex("TST", "2", "201")
+	if _, err := g.Route(from, to, ProfileAccessible); err != ErrNoStepFreeRoute {
+		t.Errorf("got error %v, want %v", err, ErrNoStepFreeRoute)
+	}
+	if _, err := g.Route(from, to, ""); err != nil {
+		t.Errorf("got error %v, want a route by the stairs", err)
+	}
+}
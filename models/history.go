@@ -0,0 +1,243 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var HistoryPath = "./history"
+
+// Revision is a saved version of a building.
+type Revision struct {
+	Rev      int       `json:"rev"`
+	SIS      string    `json:"sis"`
+	Author   string    `json:"author,omitempty"`
+	Time     time.Time `json:"time"`
+	RevertOf *int      `json:"revert_of,omitempty"`
+	Building *Building `json:"building,omitempty"`
+}
+
+func revisionDir(sis string) string {
+	return filepath.Join(HistoryPath, sis)
+}
+
+func revisionFile(sis string, rev int) string {
+	return filepath.Join(revisionDir(sis), strconv.Itoa(rev)+".json")
+}
+
+// revisionNumbers returns the revision numbers of a building in ascending
+// order.
+func revisionNumbers(sis string) ([]int, error) {
+	files, err := ioutil.ReadDir(revisionDir(sis))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var revs []int
+	for _, f := range files {
+		rev, err := strconv.Atoi(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		revs = append(revs, rev)
+	}
+	sort.Ints(revs)
+	return revs, nil
+}
+
+// RecordRevision saves b as the next revision of the building. If the building
+// has no history yet, prev is saved first as revision 0 so the original can be
+// restored.
+func RecordRevision(prev, b *Building, author string, revertOf *int) (*Revision, error) {
+	revs, err := revisionNumbers(b.SIS)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(revisionDir(b.SIS), 0755); err != nil {
+		return nil, err
+	}
+	next := 0
+	if len(revs) > 0 {
+		next = revs[len(revs)-1] + 1
+	} else if prev != nil {
+		if err := writeRevision(&Revision{SIS: b.SIS, Time: time.Now(), Building: prev}); err != nil {
+			return nil, err
+		}
+		next = 1
+	}
+	rev := &Revision{
+		Rev:      next,
+		SIS:      b.SIS,
+		Author:   author,
+		Time:     time.Now(),
+		RevertOf: revertOf,
+		Building: b,
+	}
+	if err := writeRevision(rev); err != nil {
+		return nil, err
+	}
+	return rev, nil
+}
+
+func writeRevision(rev *Revision) error {
+	buf, err := json.MarshalIndent(rev, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(revisionFile(rev.SIS, rev.Rev), buf, 0644)
+}
+
+// LoadRevision returns a single revision of a building.
+func LoadRevision(sis string, rev int) (*Revision, error) {
+	buf, err := ioutil.ReadFile(revisionFile(sis, rev))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("revision %d of %s not found", rev, sis)
+	} else if err != nil {
+		return nil, err
+	}
+	r := &Revision{}
+	if err := json.Unmarshal(buf, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Revisions returns every revision of a building, oldest first, without the
+// building data.
+func Revisions(sis string) ([]*Revision, error) {
+	revs, err := revisionNumbers(sis)
+	if err != nil {
+		return nil, err
+	}
+	history := []*Revision{}
+	for _, rev := range revs {
+		r, err := LoadRevision(sis, rev)
+		if err != nil {
+			return nil, err
+		}
+		r.Building = nil
+		history = append(history, r)
+	}
+	return history, nil
+}
+
+// Clone returns a deep copy of the building's data.
+func (b *Building) Clone() *Building {
+	buf, err := json.Marshal(b)
+	if err != nil {
+		panic(err)
+	}
+	b2 := &Building{}
+	if err := json.Unmarshal(buf, b2); err != nil {
+		panic(err)
+	}
+	return b2
+}
+
+// Difference is a single change between two versions of a building.
+type Difference struct {
+	Action string `json:"action"`
+	Kind   string `json:"kind"`
+	Floor  string `json:"floor,omitempty"`
+	Id     string `json:"id,omitempty"`
+}
+
+// roomKeys returns a key for each room that is its id, followed by how many
+// rooms before it have the same id if any do. Rooms with duplicate ids are
+// matched up in order.
+func roomKeys(rooms []*Room) []string {
+	seen := make(map[string]int)
+	keys := make([]string, len(rooms))
+	for i, r := range rooms {
+		keys[i] = r.Id
+		if n := seen[r.Id]; n > 0 {
+			keys[i] += "#" + strconv.Itoa(n)
+		}
+		seen[r.Id]++
+	}
+	return keys
+}
+
+// roomsByKey maps the rooms by the keys from roomKeys.
+func roomsByKey(rooms []*Room) map[string]*Room {
+	m := make(map[string]*Room)
+	for i, key := range roomKeys(rooms) {
+		m[key] = rooms[i]
+	}
+	return m
+}
+
+func floorEqual(a, b *Floor) bool {
+	return a.Image == b.Image && a.Rotation == b.Rotation &&
+		reflect.DeepEqual(a.Coords, b.Coords) && reflect.DeepEqual(a.Nodes, b.Nodes) &&
+		reflect.DeepEqual(a.ControlPoints, b.ControlPoints)
+}
+
+// DiffBuildings returns the floors and rooms that were added, removed or
+// changed going from a to b, along with whether the building itself changed.
+func DiffBuildings(a, b *Building) []*Difference {
+	diffs := []*Difference{}
+	if a.Name != b.Name || a.Address != b.Address || a.Image != b.Image ||
+		a.Description != b.Description || !reflect.DeepEqual(a.Position, b.Position) ||
+		!reflect.DeepEqual(a.Occupants, b.Occupants) || !reflect.DeepEqual(a.Aliases, b.Aliases) {
+		diffs = append(diffs, &Difference{Action: "changed", Kind: "building"})
+	}
+
+	floorsA := make(map[string]*Floor)
+	for _, f := range a.Floors {
+		floorsA[f.Name] = f
+	}
+	floorsB := make(map[string]*Floor)
+	for _, f := range b.Floors {
+		floorsB[f.Name] = f
+	}
+	for _, f := range a.Floors {
+		if floorsB[f.Name] == nil {
+			diffs = append(diffs, &Difference{Action: "removed", Kind: "floor", Floor: f.Name})
+		}
+	}
+	for _, fb := range b.Floors {
+		fa := floorsA[fb.Name]
+		if fa == nil {
+			diffs = append(diffs, &Difference{Action: "added", Kind: "floor", Floor: fb.Name})
+			fa = &Floor{}
+		} else if !floorEqual(fa, fb) {
+			diffs = append(diffs, &Difference{Action: "changed", Kind: "floor", Floor: fb.Name})
+		}
+
+		roomsA := roomsByKey(fa.Rooms)
+		roomsB := roomsByKey(fb.Rooms)
+		keysA := roomKeys(fa.Rooms)
+		for i, r := range fa.Rooms {
+			if roomsB[keysA[i]] == nil {
+				diffs = append(diffs, &Difference{Action: "removed", Kind: "room", Floor: fb.Name, Id: r.Id})
+			}
+		}
+		for i, key := range roomKeys(fb.Rooms) {
+			r := fb.Rooms[i]
+			if ra := roomsA[key]; ra == nil {
+				diffs = append(diffs, &Difference{Action: "added", Kind: "room", Floor: fb.Name, Id: r.Id})
+			} else if !reflect.DeepEqual(ra, r) {
+				diffs = append(diffs, &Difference{Action: "changed", Kind: "room", Floor: fb.Name, Id: r.Id})
+			}
+		}
+	}
+	for _, fa := range a.Floors {
+		if floorsB[fa.Name] != nil {
+			continue
+		}
+		for _, r := range fa.Rooms {
+			diffs = append(diffs, &Difference{Action: "removed", Kind: "room", Floor: fa.Name, Id: r.Id})
+		}
+	}
+	return diffs
+}
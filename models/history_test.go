@@ -0,0 +1,156 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// useTempPaths points the map data and history at a temporary directory and
+// returns a function restoring them.
+func useTempPaths(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "campus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapDataPath, historyPath := MapDataPath, HistoryPath
+	MapDataPath = filepath.Join(dir, "map.json")
+	HistoryPath = filepath.Join(dir, "history")
+	return func() {
+		MapDataPath, HistoryPath = mapDataPath, historyPath
+		os.RemoveAll(dir)
+	}
+}
+
+func historyBuilding() *Building {
+	return &Building{
+		SIS:  "TST",
+		Name: "Test Building",
+		Floors: []*Floor{{
+			Name:   "1",
+			Coords: &Coords{North: 2, South: 1, East: 2, West: 1},
+			Rooms: []*Room{
+				{Id: "101", Name: "Lecture Hall", SIS: "TST", Floor: "1"},
+				{Id: "102", Name: "Office", SIS: "TST", Floor: "1"},
+			},
+		}},
+	}
+}
+
+func TestRecordRevision(t *testing.T) {
+	defer useTempPaths(t)()
+
+	prev := historyBuilding()
+	b := historyBuilding()
+	b.Name = "Renamed"
+	rev, err := RecordRevision(prev, b, "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first edit also records the original as revision 0.
+	if rev.Rev != 1 {
+		t.Errorf("got revision %d, want 1", rev.Rev)
+	}
+	original, err := LoadRevision("TST", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(original.Building, prev) || len(original.Author) > 0 {
+		t.Errorf("got revision 0 %+v by %q, want the original building", original.Building, original.Author)
+	}
+
+	b2 := historyBuilding()
+	b2.Name = "Renamed Again"
+	rev0 := 0
+	if rev, err = RecordRevision(b, b2, "bob", &rev0); err != nil {
+		t.Fatal(err)
+	}
+	if rev.Rev != 2 {
+		t.Errorf("got revision %d, want 2", rev.Rev)
+	}
+
+	revs, err := Revisions("TST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 3 {
+		t.Fatalf("got %d revisions, want 3", len(revs))
+	}
+	for i, r := range revs {
+		if r.Rev != i || r.SIS != "TST" || r.Building != nil {
+			t.Errorf("revision %d: got %+v", i, r)
+		}
+	}
+	if revs[1].Author != "alice" || revs[1].RevertOf != nil {
+		t.Errorf("got revision 1 by %q reverting %v, want alice", revs[1].Author, revs[1].RevertOf)
+	}
+	if revs[2].Author != "bob" || revs[2].RevertOf == nil || *revs[2].RevertOf != 0 {
+		t.Errorf("got revision 2 by %q reverting %v, want bob reverting 0", revs[2].Author, revs[2].RevertOf)
+	}
+	latest, err := LoadRevision("TST", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Building.Name != "Renamed Again" {
+		t.Errorf("got revision 2 named %q", latest.Building.Name)
+	}
+
+	if _, err := LoadRevision("TST", 3); err == nil {
+		t.Error("loaded a missing revision")
+	}
+	if revs, err := Revisions("NONE"); err != nil || len(revs) != 0 {
+		t.Errorf("got revisions %v, %v for a building without history", revs, err)
+	}
+}
+
+func TestDiffBuildings(t *testing.T) {
+	a := historyBuilding()
+	a.Floors = append(a.Floors, &Floor{Name: "2", Rooms: []*Room{{Id: "201"}}})
+
+	b := historyBuilding()
+	b.Floors[0].Rotation = 0.5
+	b.Floors[0].Rooms[0].Name = "Theatre"
+	b.Floors[0].Rooms = append(b.Floors[0].Rooms[:1], &Room{Id: "103"})
+	b.Floors = append(b.Floors, &Floor{Name: "3", Rooms: []*Room{{Id: "301"}}})
+
+	got := DiffBuildings(a, b)
+	want := []*Difference{
+		{Action: "removed", Kind: "floor", Floor: "2"},
+		{Action: "changed", Kind: "floor", Floor: "1"},
+		{Action: "removed", Kind: "room", Floor: "1", Id: "102"},
+		{Action: "changed", Kind: "room", Floor: "1", Id: "101"},
+		{Action: "added", Kind: "room", Floor: "1", Id: "103"},
+		{Action: "added", Kind: "floor", Floor: "3"},
+		{Action: "added", Kind: "room", Floor: "3", Id: "301"},
+		{Action: "removed", Kind: "room", Floor: "2", Id: "201"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got differences:")
+		for _, d := range got {
+			t.Errorf("  %+v", d)
+		}
+	}
+
+	if diffs := DiffBuildings(a, a.Clone()); len(diffs) != 0 {
+		t.Errorf("got differences %v between equal buildings", diffs)
+	}
+	// Rooms with the same id are matched up in order.
+	d := a.Clone()
+	d.Floors[0].Rooms = append(d.Floors[0].Rooms, &Room{Id: "101", Name: "Duplicate"})
+	if diffs := DiffBuildings(d, d.Clone()); len(diffs) != 0 {
+		t.Errorf("got differences %v between equal buildings with duplicate rooms", diffs)
+	}
+	e := d.Clone()
+	e.Floors[0].Rooms[2].Name = "Renamed Duplicate"
+	if diffs := DiffBuildings(d, e); len(diffs) != 1 || diffs[0].Action != "changed" || diffs[0].Id != "101" {
+		t.Errorf("got differences %v, want the duplicate room changed", diffs)
+	}
+
+	c := a.Clone()
+	c.Name = "Renamed"
+	if diffs := DiffBuildings(a, c); len(diffs) != 1 || diffs[0].Kind != "building" {
+		t.Errorf("got differences %v, want the building changed", diffs)
+	}
+}
@@ -5,43 +5,173 @@ import (
 	"image"
 	"image/draw"
 	"log"
+	"math"
 	"os"
+	"regexp"
+	"strings"
 	"sync"
+
+	"github.com/srwiley/oksvg"
 )
 
 type Building struct {
 	Floors      []*Floor `json:"floors,omitempty"`
 	Name        string   `json:"name,omitempty"`
 	SIS         string   `json:"sis,omitempty"`
+	Aliases     []string `json:"aliases,omitempty"`
 	Position    *LatLng  `json:"position,omitempty"`
 	Address     string
 	Image       string
 	Description string
+	Occupants   []string `json:"occupants,omitempty"`
+	Version     int      `json:"version,omitempty"`
 }
 
 func (b Building) Meta() *Building {
 	return &Building{
-		Name:     b.Name,
-		SIS:      b.SIS,
-		Position: b.Position,
-		Address:  b.Address,
-		Image:    b.Image,
+		Name:      b.Name,
+		SIS:       b.SIS,
+		Aliases:   b.Aliases,
+		Position:  b.Position,
+		Address:   b.Address,
+		Image:     b.Image,
+		Occupants: b.Occupants,
 	}
 }
 
+// occupantSeparator matches the directory and web site links after each
+// occupant in a scraped description, e.g. "Library [D] [W]- ".
+var occupantSeparator = regexp.MustCompile(`\s*(\[[DW]\]\s*)+-?\s*`)
+
+// ParseOccupants returns the departments and services listed in the
+// "Occupant(s)" section of a scraped building description.
+func ParseOccupants(description string) []string {
+	i := strings.Index(description, "Occupant(s)")
+	if i < 0 {
+		return nil
+	}
+	list := description[i:]
+	// Skip the instructions before the list.
+	if j := strings.Index(list, "Web Sites."); j >= 0 {
+		list = list[j+len("Web Sites."):]
+	}
+	list = strings.TrimPrefix(strings.TrimSpace(list), "-")
+
+	var occupants []string
+	for _, occupant := range occupantSeparator.Split(list, -1) {
+		occupant = strings.Join(strings.Fields(occupant), " ")
+		if len(occupant) > 0 {
+			occupants = append(occupants, occupant)
+		}
+	}
+	return occupants
+}
+
 type Floor struct {
 	Name     string  `json:"floor,omitempty"`
 	Coords   *Coords `json:"coords,omitempty"`
 	Image    string  `json:"image,omitempty"`
 	Rooms    []*Room `json:"rooms,omitempty"`
 	Rotation float64 `json:"rotation,omitempty"`
+	Nodes    []*Node `json:"nodes,omitempty"`
+	// ControlPoints georeference the image in place of Coords and Rotation.
+	// There must be either none or at least three of them.
+	ControlPoints []*ControlPoint `json:"control_points,omitempty"`
+	// Transform is fitted to the control points by Georeference.
+	Transform *Affine `json:"transform,omitempty"`
+	// RMS is the root mean square residual of the control points in metres.
+	RMS float64 `json:"rms,omitempty"`
+
+	imageOnce sync.Once
+	image     image.Image
+	imageErr  error
 
-	RotatedImage draw.Image     `json:"-"`
-	ImageWG      sync.WaitGroup `json:"-"`
-	ImageOnce    sync.Once      `json:"-"`
+	svgOnce sync.Once
+	svg     *oksvg.SvgIcon
+	svgErr  error
+
+	levelsMu sync.Mutex
+	levels   []*image.RGBA
+}
+
+// SourceImage returns the floor image, loading it the first time it's used.
+func (f *Floor) SourceImage() (image.Image, error) {
+	f.imageOnce.Do(func() {
+		f.image, f.imageErr = f.LoadImage()
+	})
+	return f.image, f.imageErr
 }
 
+// SourceLevel returns the floor image downsampled by a factor of 2^level,
+// building the levels of the pyramid the first time they're used. Level 0 is
+// the source image. Levels past the smallest, which is a single pixel wide or
+// high, return the smallest.
+func (f *Floor) SourceLevel(level int) (image.Image, error) {
+	img, err := f.SourceImage()
+	if err != nil || level <= 0 {
+		return img, err
+	}
+
+	f.levelsMu.Lock()
+	defer f.levelsMu.Unlock()
+	for len(f.levels) < level {
+		var prev *image.RGBA
+		if len(f.levels) == 0 {
+			bounds := img.Bounds()
+			prev = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+			draw.Draw(prev, prev.Bounds(), img, bounds.Min, draw.Src)
+		} else {
+			prev = f.levels[len(f.levels)-1]
+		}
+		if prev.Rect.Dx() == 1 || prev.Rect.Dy() == 1 {
+			break
+		}
+		f.levels = append(f.levels, halveImage(prev))
+	}
+	if len(f.levels) == 0 {
+		return img, nil
+	}
+	if level > len(f.levels) {
+		level = len(f.levels)
+	}
+	return f.levels[level-1], nil
+}
+
+// halveImage returns the image at half the size, averaging each 2x2 block of
+// premultiplied pixels. A trailing odd row or column is averaged on its own.
+func halveImage(src *image.RGBA) *image.RGBA {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, (w+1)/2, (h+1)/2))
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		y0, y1 := 2*y, 2*y+1
+		if y1 >= h {
+			y1 = y0
+		}
+		for x := 0; x < dst.Rect.Dx(); x++ {
+			x0, x1 := 2*x, 2*x+1
+			if x1 >= w {
+				x1 = x0
+			}
+			d := dst.Pix[dst.PixOffset(x, y):]
+			a := src.Pix[src.PixOffset(x0, y0):]
+			b := src.Pix[src.PixOffset(x1, y0):]
+			c := src.Pix[src.PixOffset(x0, y1):]
+			e := src.Pix[src.PixOffset(x1, y1):]
+			for i := 0; i < 4; i++ {
+				d[i] = uint8((uint32(a[i]) + uint32(b[i]) + uint32(c[i]) + uint32(e[i]) + 2) / 4)
+			}
+		}
+	}
+	return dst
+}
+
+// LoadImage loads the floor plan. Vector floor plans aren't rasterized, since
+// that takes tens of seconds for a large one; draw them with SourceSVG and
+// DrawSVG instead.
 func (f *Floor) LoadImage() (draw.Image, error) {
+	if f.IsSVG() {
+		return nil, ErrVectorImage
+	}
 	log.Printf("Loading image: %s", f.Image)
 	fImg, err := os.Open("static/" + f.Image)
 	if err != nil {
@@ -59,6 +189,39 @@ func (f *Floor) LoadImage() (draw.Image, error) {
 	return image, nil
 }
 
+// RelToLatLng converts a position relative to the unrotated floor image, with
+// the origin in the top left, to a LatLng. Floors georeferenced by control
+// points use their fitted transform. Otherwise the image is rotated about its
+// center and scaled to fit within the floor's coords.
+func (f *Floor) RelToLatLng(rel *LatLng) *LatLng {
+	if f.Transform != nil {
+		return f.Transform.Apply(rel)
+	}
+	w, h := f.Coords.DLng(), f.Coords.DLat()
+	sin, cos := math.Sincos(f.Rotation)
+	dx := math.Abs(w*cos) + math.Abs(h*sin)
+	dy := math.Abs(w*sin) + math.Abs(h*cos)
+	x := (rel.Lng - 0.5) * w
+	y := (1 - rel.Lat - 0.5) * h
+	px := (cos*x+sin*y)/dx + 0.5
+	py := (cos*y-sin*x)/dy + 0.5
+	return &LatLng{
+		Lat: py*h + f.Coords.South,
+		Lng: px*w + f.Coords.West,
+	}
+}
+
+// Footprint returns the corners of the rotated floor image, clockwise from the
+// top left.
+func (f *Floor) Footprint() []*LatLng {
+	return []*LatLng{
+		f.RelToLatLng(&LatLng{Lat: 0, Lng: 0}),
+		f.RelToLatLng(&LatLng{Lat: 0, Lng: 1}),
+		f.RelToLatLng(&LatLng{Lat: 1, Lng: 1}),
+		f.RelToLatLng(&LatLng{Lat: 1, Lng: 0}),
+	}
+}
+
 type Coords struct {
 	North float64 `json:"north,omitempty"`
 	South float64 `json:"south,omitempty"`
@@ -89,13 +252,20 @@ func (c Coords) DLng() float64 {
 }
 
 type Room struct {
-	Id          string  `json:"id,omitempty"`
-	SIS         string  `json:"sis,omitempty"`
-	Name        string  `json:"name,omitempty"`
-	Position    *LatLng `json:"position,omitempty"`
-	RelPosition *LatLng `json:"rel_position,omitempty"`
-	Type        string  `json:"type,omitempty"`
-	Floor       string  `json:"floor,omitempty"`
+	Id          string   `json:"id,omitempty"`
+	SIS         string   `json:"sis,omitempty"`
+	Name        string   `json:"name,omitempty"`
+	Aliases     []string `json:"aliases,omitempty"`
+	Position    *LatLng  `json:"position,omitempty"`
+	RelPosition *LatLng  `json:"rel_position,omitempty"`
+	Type        string   `json:"type,omitempty"`
+	Floor       string   `json:"floor,omitempty"`
+	Accessible  *bool    `json:"accessible,omitempty"`
+}
+
+// StepFree returns whether the room can be reached and used without steps.
+func (r Room) StepFree() bool {
+	return stepFree(r.Type, r.Accessible)
 }
 
 type LatLng struct {
@@ -107,8 +277,13 @@ type Index struct {
 	Id          string
 	Name        string
 	Type        string
+	SIS         string `json:",omitempty"`
 	Image       string
 	Description string
+	Aliases     []string `json:",omitempty"`
+	Accessible  bool
+	Location    *LatLng `json:",omitempty"`
+	Floor       string  `json:",omitempty"`
 
 	Item interface{} `json:"-"`
 }
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestSourceLevel checks the size and pixels of the downsampled levels of a
+// floor image.
+func TestSourceLevel(t *testing.T) {
+	// A 5x3 image with opaque white and transparent columns.
+	src := image.NewNRGBA(image.Rect(10, 10, 15, 13))
+	for y := 10; y < 13; y++ {
+		for x := 10; x < 15; x += 2 {
+			src.Set(x, y, color.White)
+		}
+	}
+	f := &Floor{}
+	f.imageOnce.Do(func() { f.image = src })
+
+	cases := []struct {
+		level int
+		w, h  int
+		// pix is the first row of the level.
+		pix []uint8
+	}{
+		{1, 3, 2, []uint8{128, 128, 128, 128, 128, 128, 128, 128, 255, 255, 255, 255}},
+		{2, 2, 1, []uint8{128, 128, 128, 128, 255, 255, 255, 255}},
+		{3, 2, 1, []uint8{128, 128, 128, 128, 255, 255, 255, 255}},
+	}
+	for _, c := range cases {
+		img, err := f.SourceLevel(c.level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rgba, ok := img.(*image.RGBA)
+		if !ok {
+			t.Fatalf("level %d: got %T, want *image.RGBA", c.level, img)
+		}
+		if rgba.Rect.Dx() != c.w || rgba.Rect.Dy() != c.h {
+			t.Errorf("level %d: got size %dx%d, want %dx%d", c.level, rgba.Rect.Dx(), rgba.Rect.Dy(), c.w, c.h)
+			continue
+		}
+		if got := rgba.Pix[:4*c.w]; string(got) != string(c.pix) {
+			t.Errorf("level %d: got first row %v, want %v", c.level, got, c.pix)
+		}
+	}
+
+	if img, err := f.SourceLevel(0); err != nil || img != image.Image(src) {
+		t.Errorf("level 0: got %v, %v, want the source image", img, err)
+	}
+}
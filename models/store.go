@@ -0,0 +1,167 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrNotFound = errors.New("building SIS not found")
+	ErrConflict = errors.New("building was modified since it was loaded")
+	ErrExists   = errors.New("building SIS already exists")
+)
+
+// Store holds the buildings and serializes changes to them. Buildings in the
+// store are never modified; changes replace them in a new slice, so the
+// snapshot returned by Buildings can be read without locking.
+type Store struct {
+	mu        sync.RWMutex
+	buildings []*Building
+}
+
+// LoadStore returns a store with the buildings from the map data.
+func LoadStore() (*Store, error) {
+	buildings, err := LoadMapData()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range buildings {
+		b.setRoomParents()
+		if b.Occupants == nil {
+			b.Occupants = ParseOccupants(b.Description)
+		}
+	}
+	return &Store{buildings: buildings}, nil
+}
+
+// setRoomParents sets the building SIS and floor name on each room.
+func (b *Building) setRoomParents() {
+	for _, f := range b.Floors {
+		for _, r := range f.Rooms {
+			r.SIS = b.SIS
+			r.Floor = f.Name
+		}
+	}
+}
+
+// Buildings returns a snapshot of the buildings. It must not be modified.
+func (s *Store) Buildings() []*Building {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.buildings
+}
+
+// Building returns the building with the SIS, or nil.
+func (s *Store) Building(sis string) *Building {
+	for _, b := range s.Buildings() {
+		if b.SIS == sis {
+			return b
+		}
+	}
+	return nil
+}
+
+// recordRevision records a revision of a building that has already been
+// saved. The change is live by then, so failing to record it is logged rather
+// than returned, and the revision is nil.
+func recordRevision(prev, b *Building, author string, revertOf *int) *Revision {
+	rev, err := RecordRevision(prev, b, author, revertOf)
+	if err != nil {
+		log.Printf("Failed to record revision of %s: %s", b.SIS, err)
+	}
+	return rev
+}
+
+// Update replaces the building with the same SIS, saves the map data and
+// records the revision. The version of b must match the stored building's,
+// otherwise ErrConflict is returned since someone else saved it first. The
+// revision is nil if it couldn't be recorded after saving.
+func (s *Store) Update(b *Building, author string, revertOf *int) (*Revision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, prev := range s.buildings {
+		if prev.SIS != b.SIS {
+			continue
+		}
+		if b.Version != prev.Version {
+			return nil, ErrConflict
+		}
+		b.Version++
+		b.setRoomParents()
+		buildings := append([]*Building(nil), s.buildings...)
+		buildings[i] = b
+		if err := saveMapData(buildings); err != nil {
+			b.Version--
+			return nil, err
+		}
+		s.buildings = buildings
+		return recordRevision(prev, b, author, revertOf), nil
+	}
+	return nil, ErrNotFound
+}
+
+// Add adds a new building, saves the map data and records it as the first
+// revision of the building. The revision is nil if it couldn't be recorded
+// after saving.
+func (s *Store) Add(b *Building, author string) (*Revision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, prev := range s.buildings {
+		if prev.SIS == b.SIS {
+			return nil, ErrExists
+		}
+	}
+	b.setRoomParents()
+	buildings := append(append([]*Building(nil), s.buildings...), b)
+	sort.Sort(BySIS(buildings))
+	if err := saveMapData(buildings); err != nil {
+		return nil, err
+	}
+	s.buildings = buildings
+	return recordRevision(nil, b, author, nil), nil
+}
+
+// Edit calls fn with copies of every building and stores the buildings whose
+// SIS fn returns as new revisions. Nothing is saved if fn returns an error.
+// Revisions that can't be recorded after saving are logged.
+func (s *Store) Edit(author string, fn func([]*Building) ([]string, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buildings := make([]*Building, len(s.buildings))
+	for i, b := range s.buildings {
+		buildings[i] = b.Clone()
+	}
+	changed, err := fn(buildings)
+	if err != nil {
+		return err
+	}
+	isChanged := make(map[string]bool)
+	for _, sis := range changed {
+		isChanged[sis] = true
+	}
+	for i, b := range buildings {
+		if isChanged[b.SIS] {
+			b.Version++
+			b.setRoomParents()
+		} else {
+			buildings[i] = s.buildings[i]
+		}
+	}
+	if err := saveMapData(buildings); err != nil {
+		return err
+	}
+	prev := s.buildings
+	s.buildings = buildings
+	for i, b := range buildings {
+		if !isChanged[b.SIS] {
+			continue
+		}
+		recordRevision(prev[i], b, author, nil)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package models
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// tempStore returns a store saved to a temporary map data file with the
+// history building and one other.
+func tempStore(t *testing.T) *Store {
+	other := &Building{SIS: "OTH", Name: "Other Building"}
+	if err := saveMapData([]*Building{historyBuilding(), other}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := LoadStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// savedBuildings returns the buildings in the map data file.
+func savedBuildings(t *testing.T) []*Building {
+	buildings, err := LoadMapData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buildings
+}
+
+func TestStoreUpdate(t *testing.T) {
+	defer useTempPaths(t)()
+	s := tempStore(t)
+
+	snapshot := s.Buildings()
+	before := snapshot[1].Clone()
+
+	b := s.Building("TST").Clone()
+	b.Name = "Renamed"
+	rev, err := s.Update(b, "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev == nil || rev.Rev != 1 || b.Version != 1 {
+		t.Errorf("got revision %+v and version %d, want revision 1 and version 1", rev, b.Version)
+	}
+	if got := s.Building("TST"); got.Name != "Renamed" || got.Version != 1 {
+		t.Errorf("got building %q version %d", got.Name, got.Version)
+	}
+	if saved := savedBuildings(t); saved[1].SIS != "TST" || saved[1].Name != "Renamed" || saved[1].Version != 1 {
+		t.Errorf("saved building %s %q version %d", saved[1].SIS, saved[1].Name, saved[1].Version)
+	}
+
+	// Earlier snapshots aren't modified by later updates.
+	if !reflect.DeepEqual(snapshot[1], before) || snapshot[1].Name != "Test Building" {
+		t.Errorf("snapshot was modified to %+v", snapshot[1])
+	}
+
+	// A second update from the same version conflicts with the first.
+	stale := historyBuilding()
+	stale.Name = "Stale"
+	if _, err := s.Update(stale, "bob", nil); err != ErrConflict {
+		t.Errorf("got error %v, want ErrConflict", err)
+	}
+	if got := s.Building("TST"); got.Name != "Renamed" {
+		t.Errorf("conflicting update was stored: %q", got.Name)
+	}
+	if saved := savedBuildings(t); saved[1].Name != "Renamed" {
+		t.Errorf("conflicting update was saved: %q", saved[1].Name)
+	}
+
+	if _, err := s.Update(&Building{SIS: "NONE"}, "bob", nil); err != ErrNotFound {
+		t.Errorf("got error %v, want ErrNotFound", err)
+	}
+}
+
+func TestStoreEdit(t *testing.T) {
+	defer useTempPaths(t)()
+	s := tempStore(t)
+	snapshot := s.Buildings()
+
+	err := s.Edit("alice", func(buildings []*Building) ([]string, error) {
+		for _, b := range buildings {
+			b.Name = "Edited"
+		}
+		return []string{"OTH"}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the returned buildings are changed, and the snapshot isn't.
+	if b := s.Building("OTH"); b.Name != "Edited" || b.Version != 1 {
+		t.Errorf("got OTH %q version %d, want it edited", b.Name, b.Version)
+	}
+	if b := s.Building("TST"); b.Name != "Test Building" || b.Version != 0 {
+		t.Errorf("got TST %q version %d, want it unchanged", b.Name, b.Version)
+	}
+	for _, b := range snapshot {
+		if b.Name == "Edited" {
+			t.Errorf("snapshot of %s was modified", b.SIS)
+		}
+	}
+	if revs, err := Revisions("OTH"); err != nil || len(revs) != 2 || revs[1].Author != "alice" {
+		t.Errorf("got revisions %v, %v, want the original and alice's", revs, err)
+	}
+	if revs, _ := Revisions("TST"); len(revs) != 0 {
+		t.Errorf("got %d revisions of the unchanged building", len(revs))
+	}
+
+	// Nothing is saved when fn fails, even if it modified the buildings.
+	want := savedBuildings(t)
+	errFailed := errors.New("failed")
+	err = s.Edit("bob", func(buildings []*Building) ([]string, error) {
+		for _, b := range buildings {
+			b.Name = "Failed"
+		}
+		return []string{"TST", "OTH"}, errFailed
+	})
+	if err != errFailed {
+		t.Errorf("got error %v, want %v", err, errFailed)
+	}
+	for _, b := range s.Buildings() {
+		if b.Name == "Failed" {
+			t.Errorf("%s was modified by a failed edit", b.SIS)
+		}
+	}
+	if got := savedBuildings(t); !reflect.DeepEqual(got, want) {
+		t.Error("map data was saved by a failed edit")
+	}
+	if revs, _ := Revisions("OTH"); len(revs) != 2 {
+		t.Errorf("got %d revisions after a failed edit, want 2", len(revs))
+	}
+}
+
+func TestStoreHistoryFailure(t *testing.T) {
+	defer useTempPaths(t)()
+	s := tempStore(t)
+	// History can't be written under a file.
+	if err := ioutil.WriteFile(HistoryPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := s.Building("TST").Clone()
+	b.Name = "Renamed"
+	rev, err := s.Update(b, "alice", nil)
+	if err != nil {
+		t.Fatalf("got error %v; the save succeeded so it should only be logged", err)
+	}
+	if rev != nil {
+		t.Errorf("got revision %+v that wasn't recorded", rev)
+	}
+	if got := s.Building("TST"); got.Name != "Renamed" {
+		t.Errorf("got building %q, want the update live", got.Name)
+	}
+}
+
+func TestSaveMapData(t *testing.T) {
+	defer useTempPaths(t)()
+	s := tempStore(t)
+
+	if err := s.Edit("alice", func(buildings []*Building) ([]string, error) {
+		return []string{"TST"}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The temporary file is renamed over the map data.
+	files, err := ioutil.ReadDir(filepath.Dir(MapDataPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.Name() != "map.json" && f.Name() != "history" {
+			t.Errorf("temporary file %s was left behind", f.Name())
+		}
+	}
+	info, err := os.Stat(MapDataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("got map data mode %s, want 0644", info.Mode())
+	}
+	if saved := savedBuildings(t); len(saved) != 2 || saved[1].Version != 1 {
+		t.Errorf("got saved buildings %v", saved)
+	}
+
+	// A failed save leaves the map data and store as they were.
+	want := savedBuildings(t)
+	MapDataPath = filepath.Join(filepath.Dir(MapDataPath), "missing", "map.json")
+	if err := s.Edit("bob", func(buildings []*Building) ([]string, error) {
+		buildings[0].Name = "Unsaved"
+		return []string{buildings[0].SIS}, nil
+	}); err == nil {
+		t.Error("saving to a missing directory succeeded")
+	}
+	if s.Buildings()[0].Name == "Unsaved" {
+		t.Error("store was changed by a failed save")
+	}
+	MapDataPath = filepath.Join(filepath.Dir(filepath.Dir(MapDataPath)), "map.json")
+	if got := savedBuildings(t); !reflect.DeepEqual(got, want) {
+		t.Error("map data was changed by a failed save")
+	}
+}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+// ErrVectorImage is returned when loading a vector floor plan as an image.
+var ErrVectorImage = errors.New("vector floor plans can't be loaded as images")
+
+// IsSVG returns whether the floor plan is a vector image.
+func (f *Floor) IsSVG() bool {
+	return strings.EqualFold(path.Ext(f.Image), ".svg")
+}
+
+// SourceSVG returns the parsed vector floor plan, loading it the first time
+// it's used.
+func (f *Floor) SourceSVG() (*oksvg.SvgIcon, error) {
+	f.svgOnce.Do(func() {
+		f.svg, f.svgErr = f.LoadSVG()
+	})
+	return f.svg, f.svgErr
+}
+
+// LoadSVG parses the vector floor plan. Unsupported elements, such as clip
+// paths, are ignored.
+func (f *Floor) LoadSVG() (*oksvg.SvgIcon, error) {
+	log.Printf("Loading SVG: %s", f.Image)
+	data, err := ioutil.ReadFile("static/" + f.Image)
+	if err != nil {
+		return nil, err
+	}
+	data = percentRGBRegexp.ReplaceAllFunc(data, percentRGBToBytes)
+	return oksvg.ReadIconStream(bytes.NewReader(data), oksvg.IgnoreErrorMode)
+}
+
+// svgSize returns the size of the root svg element's view box, falling back to
+// its width and height. Only the start of the document is read.
+func svgSize(r io.Reader) (float64, float64, error) {
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return 0, 0, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local != "svg" {
+			return 0, 0, fmt.Errorf("root element is %s, not svg", start.Name.Local)
+		}
+		attrs := make(map[string]string)
+		for _, attr := range start.Attr {
+			attrs[attr.Name.Local] = attr.Value
+		}
+		if fields := strings.FieldsFunc(attrs["viewBox"], func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\n'
+		}); len(fields) == 4 {
+			w, errW := strconv.ParseFloat(fields[2], 64)
+			h, errH := strconv.ParseFloat(fields[3], 64)
+			if errW == nil && errH == nil {
+				return w, h, nil
+			}
+		}
+		w, errW := strconv.ParseFloat(strings.TrimSuffix(attrs["width"], "px"), 64)
+		h, errH := strconv.ParseFloat(strings.TrimSuffix(attrs["height"], "px"), 64)
+		if errW != nil || errH != nil {
+			return 0, 0, errors.New("svg has no view box or size")
+		}
+		return w, h, nil
+	}
+}
+
+// percentRGBRegexp matches colors given as percentages, such as the
+// rgb(90.194702%,90.194702%,90.194702%) that pdftocairo writes. The SVG parser
+// only understands whole numbers, even with errors ignored.
+var percentRGBRegexp = regexp.MustCompile(`rgb\(\s*([0-9.]+)%\s*,\s*([0-9.]+)%\s*,\s*([0-9.]+)%\s*\)`)
+
+// percentRGBToBytes rewrites a color matched by percentRGBRegexp with byte
+// components.
+func percentRGBToBytes(color []byte) []byte {
+	m := percentRGBRegexp.FindSubmatch(color)
+	var c [3]int
+	for i := range c {
+		p, err := strconv.ParseFloat(string(m[i+1]), 64)
+		if err != nil {
+			return color
+		}
+		c[i] = int(math.Min(math.Max(math.Round(p*255/100), 0), 255))
+	}
+	return []byte(fmt.Sprintf("rgb(%d,%d,%d)", c[0], c[1], c[2]))
+}
+
+// DrawSVG draws the icon onto dst with the transform m. It's safe to draw the
+// same icon concurrently.
+func DrawSVG(dst *image.RGBA, icon *oksvg.SvgIcon, m rasterx.Matrix2D) {
+	b := dst.Bounds()
+	scanner := cullingScanner{rasterx.NewScannerGV(b.Dx(), b.Dy(), dst, b)}
+	dasher := rasterx.NewDasher(b.Dx(), b.Dy(), scanner)
+	// Drawing temporarily modifies the paths, so draw copies of them.
+	paths := append([]oksvg.SvgPath(nil), icon.SVGPaths...)
+	for i := range paths {
+		paths[i].DrawTransformed(dasher, 1, m)
+	}
+}
+
+// cullingScanner skips drawing paths that are entirely outside of the
+// destination. The vector rasterizer composites the whole destination for
+// every path, which dominates the time taken to draw large floor plans.
+type cullingScanner struct {
+	*rasterx.ScannerGV
+}
+
+func (s cullingScanner) Draw() {
+	e := s.GetPathExtent()
+	b := s.Dest.Bounds()
+	if e.Max.X.Ceil() < b.Min.X || e.Max.Y.Ceil() < b.Min.Y || e.Min.X.Floor() >= b.Max.X || e.Min.Y.Floor() >= b.Max.Y {
+		return
+	}
+	s.ScannerGV.Draw()
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/srwiley/rasterx"
+)
+
+// TestLoadBundledSVGs loads and draws every bundled vector floor plan.
+func TestLoadBundledSVGs(t *testing.T) {
+	// Floor images are relative to the static directory at the repo root.
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir("models")
+
+	files, err := filepath.Glob("static/maps/*/*.svg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Skip("no bundled SVG floor plans")
+	}
+	for _, file := range files {
+		f := &Floor{Image: filepath.ToSlash(file[len("static/"):])}
+		icon, err := f.LoadSVG()
+		if err != nil {
+			t.Errorf("%s: %s", file, err)
+			continue
+		}
+		if icon.ViewBox.W <= 0 || icon.ViewBox.H <= 0 || len(icon.SVGPaths) == 0 {
+			t.Errorf("%s: empty floor plan, view box %+v, %d paths", file, icon.ViewBox, len(icon.SVGPaths))
+			continue
+		}
+		if w, h, err := f.ImageSize(); err != nil || w != icon.ViewBox.W || h != icon.ViewBox.H {
+			t.Errorf("%s: got image size %gx%g, %v, want the view box %+v", file, w, h, err, icon.ViewBox)
+		}
+
+		// Draw a thumbnail, since drawing at the natural size is slow.
+		const size = 256
+		scale := size / icon.ViewBox.W
+		if h := size / icon.ViewBox.H; h < scale {
+			scale = h
+		}
+		img := image.NewRGBA(image.Rect(0, 0, size, size))
+		m := rasterx.Identity.Scale(scale, scale).Translate(-icon.ViewBox.X, -icon.ViewBox.Y)
+		DrawSVG(img, icon, m)
+		drawn := false
+		for i := 3; i < len(img.Pix); i += 4 {
+			if img.Pix[i] > 0 {
+				drawn = true
+				break
+			}
+		}
+		if !drawn {
+			t.Errorf("%s: nothing was drawn", file)
+		}
+	}
+}
+
+func TestPercentRGBToBytes(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"fill:rgb(90.194702%,90.194702%,90.194702%);", "fill:rgb(230,230,230);"},
+		{"rgb(0%, 50%, 100%)", "rgb(0,128,255)"},
+		{"rgb(12,34,56)", "rgb(12,34,56)"},
+	}
+	for _, c := range cases {
+		got := string(percentRGBRegexp.ReplaceAllFunc([]byte(c.in), percentRGBToBytes))
+		if got != c.want {
+			t.Errorf("%q: got %q, want %q", c.in, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package mvt
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// reader reads a protocol buffer message.
+type reader []byte
+
+var errTruncated = errors.New("mvt: truncated message")
+
+func (r *reader) varint() (uint64, error) {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		if len(*r) == 0 {
+			return 0, errTruncated
+		}
+		c := (*r)[0]
+		*r = (*r)[1:]
+		v |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return v, nil
+		}
+	}
+	return 0, errors.New("mvt: varint overflows")
+}
+
+// field reads the next field, returning its number, wire type and either its
+// varint or fixed value or its bytes.
+func (r *reader) field() (int, int, uint64, []byte, error) {
+	key, err := r.varint()
+	if err != nil {
+		return 0, 0, 0, nil, err
+	}
+	field, wire := int(key>>3), int(key&0x7)
+	switch wire {
+	case wireVarint:
+		v, err := r.varint()
+		return field, wire, v, nil, err
+	case wire64Bit:
+		if len(*r) < 8 {
+			return 0, 0, 0, nil, errTruncated
+		}
+		var v uint64
+		for i := uint(0); i < 8; i++ {
+			v |= uint64((*r)[i]) << (8 * i)
+		}
+		*r = (*r)[8:]
+		return field, wire, v, nil, nil
+	case wireBytes:
+		n, err := r.varint()
+		if err != nil {
+			return 0, 0, 0, nil, err
+		}
+		if uint64(len(*r)) < n {
+			return 0, 0, 0, nil, errTruncated
+		}
+		b := (*r)[:n]
+		*r = (*r)[n:]
+		return field, wire, 0, b, nil
+	case 5:
+		if len(*r) < 4 {
+			return 0, 0, 0, nil, errTruncated
+		}
+		v := uint64((*r)[0]) | uint64((*r)[1])<<8 | uint64((*r)[2])<<16 | uint64((*r)[3])<<24
+		*r = (*r)[4:]
+		return field, wire, v, nil, nil
+	}
+	return 0, 0, 0, nil, fmt.Errorf("mvt: unsupported wire type %d", wire)
+}
+
+// unpack returns the varints of a packed repeated field.
+func unpack(b []byte) ([]uint32, error) {
+	r := reader(b)
+	var vs []uint32
+	for len(r) > 0 {
+		v, err := r.varint()
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, uint32(v))
+	}
+	return vs, nil
+}
+
+func unzigzag(v uint32) int {
+	return int(int32(v>>1) ^ -int32(v&1))
+}
+
+// decodeGeometry returns the rings of the geometry commands. Polygon rings
+// aren't closed, as in Feature.
+func decodeGeometry(typ GeomType, cmds []uint32) ([][]Point, error) {
+	var rings [][]Point
+	var cursor Point
+	for i := 0; i < len(cmds); {
+		id, count := int(cmds[i]&0x7), int(cmds[i]>>3)
+		i++
+		switch id {
+		case cmdMoveTo, cmdLineTo:
+			if i+2*count > len(cmds) {
+				return nil, errors.New("mvt: truncated geometry")
+			}
+			for j := 0; j < count; j++ {
+				cursor.X += unzigzag(cmds[i])
+				cursor.Y += unzigzag(cmds[i+1])
+				i += 2
+				if id == cmdMoveTo && (typ != PointGeom || len(rings) == 0) {
+					rings = append(rings, nil)
+				}
+				rings[len(rings)-1] = append(rings[len(rings)-1], cursor)
+			}
+		case cmdClosePath:
+			if typ != Polygon {
+				return nil, errors.New("mvt: ClosePath in a feature that isn't a polygon")
+			}
+		default:
+			return nil, fmt.Errorf("mvt: unknown command %d", id)
+		}
+	}
+	return rings, nil
+}
+
+// decodeValue returns the property value of a Value message. Signed integers
+// are returned as ints, like the ones Marshal takes.
+func decodeValue(b []byte) (interface{}, error) {
+	r := reader(b)
+	var v interface{}
+	for len(r) > 0 {
+		field, _, n, buf, err := r.field()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			v = string(buf)
+		case 2:
+			v = float64(math.Float32frombits(uint32(n)))
+		case 3:
+			v = math.Float64frombits(n)
+		case 4:
+			v = int64(n)
+		case 5:
+			v = n
+		case 6:
+			v = int(int64(n>>1) ^ -int64(n&1))
+		case 7:
+			v = n != 0
+		}
+	}
+	return v, nil
+}
+
+// unmarshalLayer decodes a Layer message.
+func unmarshalLayer(b []byte) (*Layer, error) {
+	l := &Layer{}
+	var keys []string
+	var values []interface{}
+	type rawFeature struct {
+		*Feature
+		tags []uint32
+	}
+	var features []rawFeature
+	r := reader(b)
+	for len(r) > 0 {
+		field, _, n, buf, err := r.field()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			l.Name = string(buf)
+		case 2:
+			f := rawFeature{Feature: &Feature{}}
+			var geom []uint32
+			fr := reader(buf)
+			for len(fr) > 0 {
+				field, _, n, buf, err := fr.field()
+				if err != nil {
+					return nil, err
+				}
+				switch field {
+				case 1:
+					f.Id = n
+				case 2:
+					f.tags, err = unpack(buf)
+				case 3:
+					f.Type = GeomType(n)
+				case 4:
+					geom, err = unpack(buf)
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+			if f.Geometry, err = decodeGeometry(f.Type, geom); err != nil {
+				return nil, err
+			}
+			features = append(features, f)
+		case 3:
+			keys = append(keys, string(buf))
+		case 4:
+			v, err := decodeValue(buf)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		case 5:
+			l.Extent = uint32(n)
+		}
+	}
+	for _, f := range features {
+		if len(f.tags)%2 != 0 {
+			return nil, errors.New("mvt: odd number of tags")
+		}
+		if len(f.tags) > 0 {
+			f.Properties = make(map[string]interface{})
+		}
+		for i := 0; i < len(f.tags); i += 2 {
+			k, v := int(f.tags[i]), int(f.tags[i+1])
+			if k >= len(keys) || v >= len(values) {
+				return nil, errors.New("mvt: tag out of range")
+			}
+			f.Properties[keys[k]] = values[v]
+		}
+		l.Features = append(l.Features, f.Feature)
+	}
+	return l, nil
+}
+
+// Unmarshal decodes a tile encoded by Marshal or any other encoder of the
+// specification.
+func Unmarshal(b []byte) (*Tile, error) {
+	t := &Tile{}
+	r := reader(b)
+	for len(r) > 0 {
+		field, _, _, buf, err := r.field()
+		if err != nil {
+			return nil, err
+		}
+		if field != 3 {
+			continue
+		}
+		l, err := unmarshalLayer(buf)
+		if err != nil {
+			return nil, err
+		}
+		t.Layers = append(t.Layers, l)
+	}
+	return t, nil
+}
@@ -0,0 +1,299 @@
+// Package mvt encodes and decodes Mapbox Vector Tiles, version 2.1 of the
+// specification. See https://github.com/mapbox/vector-tile-spec.
+package mvt
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// DefaultExtent is the default width and height of a tile in tile coordinates.
+const DefaultExtent = 4096
+
+// GeomType is the type of a feature's geometry.
+type GeomType int
+
+const (
+	Unknown GeomType = iota
+	PointGeom
+	LineString
+	Polygon
+)
+
+// Geometry commands.
+const (
+	cmdMoveTo    = 1
+	cmdLineTo    = 2
+	cmdClosePath = 7
+)
+
+// Protocol buffer wire types.
+const (
+	wireVarint = 0
+	wire64Bit  = 1
+	wireBytes  = 2
+)
+
+// Point is a position in tile coordinates, with y increasing downwards.
+type Point struct {
+	X, Y int
+}
+
+// Feature is a single geometry with properties. Points features have a ring
+// per point, line strings a ring per line and polygons a ring per ring.
+// Property values must be strings, floats, ints or bools.
+type Feature struct {
+	Id         uint64
+	Type       GeomType
+	Geometry   [][]Point
+	Properties map[string]interface{}
+}
+
+// Layer is a named set of features.
+type Layer struct {
+	Name     string
+	Extent   uint32
+	Features []*Feature
+}
+
+// Tile is a set of layers.
+type Tile struct {
+	Layers []*Layer
+}
+
+// buffer builds a protocol buffer message.
+type buffer []byte
+
+func (b *buffer) varint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+func (b *buffer) key(field, wire int) {
+	b.varint(uint64(field<<3 | wire))
+}
+
+func (b *buffer) uint(field int, v uint64) {
+	b.key(field, wireVarint)
+	b.varint(v)
+}
+
+func (b *buffer) bytes(field int, v []byte) {
+	b.key(field, wireBytes)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *buffer) string(field int, v string) {
+	b.bytes(field, []byte(v))
+}
+
+func (b *buffer) double(field int, v float64) {
+	b.key(field, wire64Bit)
+	bits := math.Float64bits(v)
+	for i := uint(0); i < 8; i++ {
+		*b = append(*b, byte(bits>>(8*i)))
+	}
+}
+
+func (b *buffer) packed(field int, vs []uint32) {
+	var p buffer
+	for _, v := range vs {
+		p.varint(uint64(v))
+	}
+	b.bytes(field, p)
+}
+
+func zigzag(v int) uint32 {
+	return uint32((int32(v) << 1) ^ (int32(v) >> 31))
+}
+
+func command(id, count int) uint32 {
+	return uint32(id&0x7) | uint32(count<<3)
+}
+
+// area returns twice the signed area of the ring in tile coordinates, which
+// is positive for rings that are clockwise on screen.
+func area(ring []Point) int {
+	a := 0
+	for i, p := range ring {
+		q := ring[(i+1)%len(ring)]
+		a += p.X*q.Y - q.X*p.Y
+	}
+	return a
+}
+
+// encodeGeometry returns the geometry commands for the feature. Polygon rings
+// are closed implicitly and the first ring is wound as an exterior ring.
+func encodeGeometry(f *Feature) ([]uint32, error) {
+	var cmds []uint32
+	var cursor Point
+	moveTo := func(p Point) {
+		cmds = append(cmds, zigzag(p.X-cursor.X), zigzag(p.Y-cursor.Y))
+		cursor = p
+	}
+	switch f.Type {
+	case PointGeom:
+		var points []Point
+		for _, ring := range f.Geometry {
+			points = append(points, ring...)
+		}
+		if len(points) == 0 {
+			return nil, fmt.Errorf("mvt: point feature %d has no points", f.Id)
+		}
+		cmds = append(cmds, command(cmdMoveTo, len(points)))
+		for _, p := range points {
+			moveTo(p)
+		}
+	case LineString, Polygon:
+		for i, ring := range f.Geometry {
+			if f.Type == Polygon {
+				if len(ring) > 1 && ring[0] == ring[len(ring)-1] {
+					ring = ring[:len(ring)-1]
+				}
+				if len(ring) < 3 {
+					return nil, fmt.Errorf("mvt: polygon feature %d has a ring with %d points", f.Id, len(ring))
+				}
+				// Exterior rings are clockwise and interior rings counter
+				// clockwise.
+				if (area(ring) > 0) != (i == 0) {
+					reversed := make([]Point, len(ring))
+					for j, p := range ring {
+						reversed[len(ring)-1-j] = p
+					}
+					ring = reversed
+				}
+			} else if len(ring) < 2 {
+				return nil, fmt.Errorf("mvt: line feature %d has a line with %d points", f.Id, len(ring))
+			}
+			cmds = append(cmds, command(cmdMoveTo, 1))
+			moveTo(ring[0])
+			cmds = append(cmds, command(cmdLineTo, len(ring)-1))
+			for _, p := range ring[1:] {
+				moveTo(p)
+			}
+			if f.Type == Polygon {
+				cmds = append(cmds, command(cmdClosePath, 1))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("mvt: feature %d has unknown geometry type %d", f.Id, f.Type)
+	}
+	return cmds, nil
+}
+
+// encodeValue returns the Value message for a property value.
+func encodeValue(v interface{}) ([]byte, error) {
+	var b buffer
+	switch v := v.(type) {
+	case string:
+		b.string(1, v)
+	case float64:
+		b.double(3, v)
+	case float32:
+		b.double(3, float64(v))
+	case int:
+		b.uint(6, uint64(zigzag64(int64(v))))
+	case int64:
+		b.uint(6, uint64(zigzag64(v)))
+	case bool:
+		i := uint64(0)
+		if v {
+			i = 1
+		}
+		b.uint(7, i)
+	default:
+		return nil, fmt.Errorf("mvt: unsupported property value %T", v)
+	}
+	return b, nil
+}
+
+func zigzag64(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+// marshal returns the Layer message.
+func (l *Layer) marshal() ([]byte, error) {
+	var b buffer
+	b.uint(15, 2)
+	b.string(1, l.Name)
+
+	keys := make(map[string]int)
+	var keyList []string
+	values := make(map[string]int)
+	var valueList [][]byte
+	for _, f := range l.Features {
+		var fb buffer
+		if f.Id != 0 {
+			fb.uint(1, f.Id)
+		}
+		// Sort the properties so tiles are deterministic.
+		var names []string
+		for k := range f.Properties {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		var tags []uint32
+		for _, k := range names {
+			v, err := encodeValue(f.Properties[k])
+			if err != nil {
+				return nil, err
+			}
+			ki, ok := keys[k]
+			if !ok {
+				ki = len(keyList)
+				keys[k] = ki
+				keyList = append(keyList, k)
+			}
+			vi, ok := values[string(v)]
+			if !ok {
+				vi = len(valueList)
+				values[string(v)] = vi
+				valueList = append(valueList, v)
+			}
+			tags = append(tags, uint32(ki), uint32(vi))
+		}
+		if len(tags) > 0 {
+			fb.packed(2, tags)
+		}
+		fb.uint(3, uint64(f.Type))
+		geom, err := encodeGeometry(f)
+		if err != nil {
+			return nil, err
+		}
+		fb.packed(4, geom)
+		b.bytes(2, fb)
+	}
+	for _, k := range keyList {
+		b.string(3, k)
+	}
+	for _, v := range valueList {
+		b.bytes(4, v)
+	}
+	extent := l.Extent
+	if extent == 0 {
+		extent = DefaultExtent
+	}
+	b.uint(5, uint64(extent))
+	return b, nil
+}
+
+// Marshal encodes the tile as a protocol buffer. Empty layers are omitted.
+func (t *Tile) Marshal() ([]byte, error) {
+	var b buffer
+	for _, l := range t.Layers {
+		if len(l.Features) == 0 {
+			continue
+		}
+		layer, err := l.marshal()
+		if err != nil {
+			return nil, err
+		}
+		b.bytes(3, layer)
+	}
+	return b, nil
+}
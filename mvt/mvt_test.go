@@ -0,0 +1,151 @@
+package mvt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestZigzag(t *testing.T) {
+	for v, want := range map[int]uint32{0: 0, -1: 1, 1: 2, -2: 3, 2: 4, 2047: 4094, -2048: 4095} {
+		if got := zigzag(v); got != want {
+			t.Errorf("zigzag(%d) = %d, want %d", v, got, want)
+		}
+		if got := unzigzag(want); got != v {
+			t.Errorf("unzigzag(%d) = %d, want %d", want, got, v)
+		}
+	}
+}
+
+// TestEncodeGeometry checks the examples of section 4.3.5 of the
+// specification.
+func TestEncodeGeometry(t *testing.T) {
+	cases := []struct {
+		name string
+		f    *Feature
+		want []uint32
+	}{
+		{"point", &Feature{Type: PointGeom, Geometry: [][]Point{{{25, 17}}}}, []uint32{9, 50, 34}},
+		{"multi point", &Feature{Type: PointGeom, Geometry: [][]Point{{{5, 7}}, {{3, 2}}}}, []uint32{17, 10, 14, 3, 9}},
+		{"line string", &Feature{Type: LineString, Geometry: [][]Point{{{2, 2}, {2, 10}, {10, 10}}}}, []uint32{9, 4, 4, 18, 0, 16, 16, 0}},
+		{"multi line string", &Feature{Type: LineString, Geometry: [][]Point{{{2, 2}, {2, 10}, {10, 10}}, {{1, 1}, {3, 5}}}},
+			[]uint32{9, 4, 4, 18, 0, 16, 16, 0, 9, 17, 17, 10, 4, 8}},
+		{"polygon", &Feature{Type: Polygon, Geometry: [][]Point{{{3, 6}, {8, 12}, {20, 34}, {3, 6}}}}, []uint32{9, 6, 12, 18, 10, 12, 24, 44, 15}},
+		// A counter clockwise exterior ring is reversed, and so is a clockwise
+		// interior ring. The cursor carries over from the first ring.
+		{"polygon winding", &Feature{Type: Polygon, Geometry: [][]Point{
+			{{0, 0}, {0, 10}, {10, 10}, {10, 0}},
+			{{11, 11}, {20, 11}, {20, 20}, {11, 20}},
+		}}, []uint32{9, 20, 0, 26, 0, 20, 19, 0, 0, 19, 15, 9, 22, 40, 26, 18, 0, 0, 17, 17, 0, 15}},
+	}
+	for _, c := range cases {
+		got, err := encodeGeometry(c.f)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	if _, err := encodeGeometry(&Feature{Type: Polygon, Geometry: [][]Point{{{0, 0}, {1, 1}, {0, 0}}}}); err == nil {
+		t.Error("encoded a polygon ring with two points")
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	// The Tile message with a single Layer message of a point feature with
+	// one property.
+	tile := &Tile{Layers: []*Layer{{
+		Name:     "a",
+		Features: []*Feature{{Id: 1, Type: PointGeom, Geometry: [][]Point{{{25, 17}}}, Properties: map[string]interface{}{"k": "v"}}},
+	}}}
+	want := []byte{
+		0x1a, 31, // layers, 31 bytes
+		0x78, 2, // version 2
+		0x0a, 1, 'a', // name
+		0x12, 13, // features, 13 bytes
+		0x08, 1, // id
+		0x12, 2, 0, 0, // tags
+		0x18, 1, // type point
+		0x22, 3, 9, 50, 34, // geometry
+		0x1a, 1, 'k', // keys
+		0x22, 3, 0x0a, 1, 'v', // values
+		0x28, 0x80, 0x20, // extent 4096
+	}
+	got, err := tile.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	tile := &Tile{Layers: []*Layer{
+		{
+			Name: "floors",
+			Features: []*Feature{{
+				Id:       7,
+				Type:     Polygon,
+				Geometry: [][]Point{{{0, 0}, {4096, 0}, {4096, 4096}, {0, 4096}}, {{10, 10}, {10, 20}, {20, 20}, {20, 10}}},
+				Properties: map[string]interface{}{
+					"sis":   "ICCS",
+					"floor": "2",
+					"area":  12.5,
+					"level": -1,
+					"open":  true,
+				},
+			}},
+		},
+		{
+			Name:   "rooms",
+			Extent: 512,
+			Features: []*Feature{
+				{Type: PointGeom, Geometry: [][]Point{{{-5, 600}}}, Properties: map[string]interface{}{"id": "X150", "sis": "ICCS"}},
+				{Type: LineString, Geometry: [][]Point{{{1, 2}, {3, 4}}}},
+			},
+		},
+		// Empty layers are left out.
+		{Name: "buildings"},
+	}}
+	buf, err := tile.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Unmarshal(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tile.Layers = tile.Layers[:2]
+	tile.Layers[0].Extent = DefaultExtent
+	if len(got.Layers) != len(tile.Layers) {
+		t.Fatalf("got %d layers, want %d", len(got.Layers), len(tile.Layers))
+	}
+	for i, l := range got.Layers {
+		want := tile.Layers[i]
+		if l.Name != want.Name || l.Extent != want.Extent || len(l.Features) != len(want.Features) {
+			t.Errorf("got layer %q extent %d with %d features, want %q extent %d with %d", l.Name, l.Extent, len(l.Features), want.Name, want.Extent, len(want.Features))
+			continue
+		}
+		for j, f := range l.Features {
+			if !reflect.DeepEqual(f, want.Features[j]) {
+				t.Errorf("layer %s: got feature %+v, want %+v", l.Name, f, want.Features[j])
+			}
+		}
+	}
+
+	// The exterior ring is clockwise on screen, which has a positive area in
+	// tile coordinates, and the interior ring counter clockwise.
+	rings := got.Layers[0].Features[0].Geometry
+	if area(rings[0]) <= 0 || area(rings[1]) >= 0 {
+		t.Errorf("got ring areas %d and %d, want positive and negative", area(rings[0]), area(rings[1]))
+	}
+
+	if _, err := Unmarshal(buf[:len(buf)-1]); err == nil {
+		t.Error("decoded a truncated tile")
+	}
+}
@@ -0,0 +1,331 @@
+// Package osm converts between OpenStreetMap Simple Indoor Tagging and the
+// campus map data.
+package osm
+
+import (
+	"encoding/xml"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/d4l3k/campus/models"
+)
+
+// amenities maps room types to OSM amenity tags.
+var amenities = map[string]string{
+	"restroom": "toilets",
+	"printer":  "printer",
+	"food":     "fast_food",
+}
+
+// roomTypes maps OSM tags to room types.
+var roomTypes = map[[2]string]string{
+	{"amenity", "toilets"}:    "restroom",
+	{"amenity", "printer"}:    "printer",
+	{"amenity", "fast_food"}:  "food",
+	{"amenity", "cafe"}:       "food",
+	{"amenity", "restaurant"}: "food",
+	{"highway", "elevator"}:   "elevator",
+	{"stairs", "yes"}:         "stairs",
+}
+
+type Tag struct {
+	K string `xml:"k,attr"`
+	V string `xml:"v,attr"`
+}
+
+type Node struct {
+	Id   int64   `xml:"id,attr"`
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Tags []Tag   `xml:"tag"`
+}
+
+type NodeRef struct {
+	Ref int64 `xml:"ref,attr"`
+}
+
+type Way struct {
+	Id    int64     `xml:"id,attr"`
+	Nodes []NodeRef `xml:"nd"`
+	Tags  []Tag     `xml:"tag"`
+}
+
+type OSM struct {
+	XMLName   xml.Name `xml:"osm"`
+	Version   string   `xml:"version,attr"`
+	Generator string   `xml:"generator,attr"`
+	Nodes     []*Node  `xml:"node"`
+	Ways      []*Way   `xml:"way"`
+}
+
+func tags(ts []Tag) map[string]string {
+	m := make(map[string]string)
+	for _, t := range ts {
+		m[t.K] = t.V
+	}
+	return m
+}
+
+// level returns the first level of a possibly multi-level value like "0;1".
+func level(v string) string {
+	return strings.TrimSpace(strings.Split(v, ";")[0])
+}
+
+type area struct {
+	tags    map[string]string
+	ring    []*models.LatLng
+	center  *models.LatLng
+	bounds  *models.Coords
+	polygon bool
+}
+
+func (a area) contains(p *models.LatLng) bool {
+	if !a.polygon || !a.bounds.OverlapLatLng(p) {
+		return false
+	}
+	in := false
+	for i, j := 0, len(a.ring)-1; i < len(a.ring); j, i = i, i+1 {
+		pi, pj := a.ring[i], a.ring[j]
+		if (pi.Lat > p.Lat) != (pj.Lat > p.Lat) &&
+			p.Lng < (pj.Lng-pi.Lng)*(p.Lat-pi.Lat)/(pj.Lat-pi.Lat)+pi.Lng {
+			in = !in
+		}
+	}
+	return in
+}
+
+func newArea(t map[string]string, ring []*models.LatLng) *area {
+	a := &area{
+		tags: t,
+		ring: ring,
+		bounds: &models.Coords{
+			North: math.Inf(-1),
+			South: math.Inf(1),
+			East:  math.Inf(-1),
+			West:  math.Inf(1),
+		},
+		polygon: len(ring) > 2,
+	}
+	var lat, lng float64
+	for _, p := range ring {
+		a.bounds.North = math.Max(a.bounds.North, p.Lat)
+		a.bounds.South = math.Min(a.bounds.South, p.Lat)
+		a.bounds.East = math.Max(a.bounds.East, p.Lng)
+		a.bounds.West = math.Min(a.bounds.West, p.Lng)
+		lat += p.Lat
+		lng += p.Lng
+	}
+	n := float64(len(ring))
+	if a.polygon && *ring[0] == *ring[len(ring)-1] {
+		// Don't count the closing node twice.
+		lat -= ring[0].Lat
+		lng -= ring[0].Lng
+		n--
+	}
+	a.center = &models.LatLng{Lat: lat / n, Lng: lng / n}
+	return a
+}
+
+// Read reads buildings, levels and rooms from an OSM XML extract. Buildings
+// are matched to the existing buildings by their ref or name and returned
+// with the SIS of the match. Levels come from indoor=level areas and rooms
+// from indoor=room nodes and areas that lie within a matched building.
+// Levels that only have rooms get the bounds of the building outline.
+func Read(r io.Reader, existing []*models.Building) ([]*models.Building, error) {
+	var data OSM
+	if err := xml.NewDecoder(r).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	bySIS := make(map[string]*models.Building)
+	byName := make(map[string]*models.Building)
+	for _, b := range existing {
+		bySIS[strings.ToUpper(b.SIS)] = b
+		byName[strings.ToLower(b.Name)] = b
+	}
+
+	nodes := make(map[int64]*Node)
+	var areas []*area
+	for _, n := range data.Nodes {
+		nodes[n.Id] = n
+		if t := tags(n.Tags); len(t["indoor"]) > 0 {
+			areas = append(areas, newArea(t, []*models.LatLng{{Lat: n.Lat, Lng: n.Lon}}))
+		}
+	}
+	// Ways that cross the edge of the extract reference nodes outside of it.
+	// Their shape is unknown, so they're skipped.
+ways:
+	for _, w := range data.Ways {
+		var ring []*models.LatLng
+		for _, nd := range w.Nodes {
+			n, ok := nodes[nd.Ref]
+			if !ok {
+				log.Printf("Skipping incomplete way %d: missing node %d", w.Id, nd.Ref)
+				continue ways
+			}
+			ring = append(ring, &models.LatLng{Lat: n.Lat, Lng: n.Lon})
+		}
+		if len(ring) > 0 {
+			areas = append(areas, newArea(tags(w.Tags), ring))
+		}
+	}
+
+	type outline struct {
+		area     *area
+		building *models.Building
+		floors   map[string]*models.Floor
+	}
+	var outlines []*outline
+	for _, a := range areas {
+		if len(a.tags["building"]) == 0 || !a.polygon {
+			continue
+		}
+		match := bySIS[strings.ToUpper(a.tags["ref"])]
+		if match == nil {
+			match = byName[strings.ToLower(a.tags["name"])]
+		}
+		if match == nil {
+			continue
+		}
+		outlines = append(outlines, &outline{
+			area: a,
+			building: &models.Building{
+				Name:     match.Name,
+				SIS:      match.SIS,
+				Position: a.center,
+			},
+			floors: make(map[string]*models.Floor),
+		})
+	}
+	within := func(p *models.LatLng) *outline {
+		for _, o := range outlines {
+			if o.area.contains(p) {
+				return o
+			}
+		}
+		return nil
+	}
+	floor := func(o *outline, name string) *models.Floor {
+		f, ok := o.floors[name]
+		if !ok {
+			f = &models.Floor{Name: name}
+			o.floors[name] = f
+		}
+		return f
+	}
+
+	for _, a := range areas {
+		if a.tags["indoor"] != "level" || !a.polygon || len(a.tags["level"]) == 0 {
+			continue
+		}
+		if o := within(a.center); o != nil {
+			floor(o, level(a.tags["level"])).Coords = a.bounds
+		}
+	}
+	for _, a := range areas {
+		if a.tags["indoor"] != "room" || len(a.tags["level"]) == 0 {
+			continue
+		}
+		o := within(a.center)
+		if o == nil {
+			continue
+		}
+		id := a.tags["ref"]
+		if len(id) == 0 {
+			id = a.tags["name"]
+		}
+		if len(id) == 0 {
+			continue
+		}
+		var typ string
+		for k, v := range a.tags {
+			if t, ok := roomTypes[[2]string{k, v}]; ok {
+				typ = t
+				break
+			}
+		}
+		f := floor(o, level(a.tags["level"]))
+		f.Rooms = append(f.Rooms, &models.Room{
+			Id:       id,
+			SIS:      o.building.SIS,
+			Name:     a.tags["name"],
+			Type:     typ,
+			Floor:    f.Name,
+			Position: a.center,
+		})
+	}
+
+	var buildings []*models.Building
+	for _, o := range outlines {
+		var names []string
+		for name := range o.floors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			f := o.floors[name]
+			if f.Coords == nil {
+				f.Coords = o.area.bounds
+			}
+			o.building.Floors = append(o.building.Floors, f)
+		}
+		buildings = append(buildings, o.building)
+	}
+	return buildings, nil
+}
+
+// Write writes the rooms of the buildings as new OSM nodes tagged with
+// indoor=room, level, ref, name and amenity.
+func Write(w io.Writer, buildings []*models.Building) error {
+	data := &OSM{
+		Version:   "0.6",
+		Generator: "campus",
+	}
+	var id int64
+	for _, b := range buildings {
+		for _, f := range b.Floors {
+			for _, r := range f.Rooms {
+				if r.Position == nil {
+					continue
+				}
+				id--
+				n := &Node{
+					Id:  id,
+					Lat: r.Position.Lat,
+					Lon: r.Position.Lng,
+					Tags: []Tag{
+						{"indoor", "room"},
+						{"level", f.Name},
+						{"ref", r.Id},
+					},
+				}
+				if len(r.Name) > 0 {
+					n.Tags = append(n.Tags, Tag{"name", r.Name})
+				}
+				if amenity, ok := amenities[r.Type]; ok {
+					n.Tags = append(n.Tags, Tag{"amenity", amenity})
+				}
+				switch r.Type {
+				case "elevator":
+					n.Tags = append(n.Tags, Tag{"highway", "elevator"})
+				case "stairs":
+					n.Tags = append(n.Tags, Tag{"stairs", "yes"})
+				}
+				data.Nodes = append(data.Nodes, n)
+			}
+		}
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	if err := e.Encode(data); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
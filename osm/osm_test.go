@@ -0,0 +1,116 @@
+package osm
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/d4l3k/campus/models"
+)
+
+func TestRead(t *testing.T) {
+	f, err := os.Open("testdata/indoor.osm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	existing := []*models.Building{
+		{Name: "Test Building", SIS: "TST"},
+		{Name: "Elsewhere", SIS: "ELS"},
+	}
+	buildings, err := Read(f, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buildings) != 1 {
+		t.Fatalf("got %d buildings, want 1", len(buildings))
+	}
+	b := buildings[0]
+	if b.SIS != "TST" || b.Name != "Test Building" {
+		t.Errorf("got building %q %q, want TST Test Building", b.SIS, b.Name)
+	}
+	if !near(b.Position, &models.LatLng{Lat: 49.2605, Lng: -123.2495}) {
+		t.Errorf("got building position %+v", b.Position)
+	}
+
+	want := []struct {
+		name   string
+		coords models.Coords
+		rooms  []models.Room
+	}{
+		{
+			name:   "0",
+			coords: models.Coords{North: 49.2609, South: 49.2601, East: -123.2491, West: -123.2499},
+			rooms: []models.Room{
+				{Id: "101", Name: "Lecture Hall", Position: &models.LatLng{Lat: 49.2603, Lng: -123.2497}},
+			},
+		},
+		{
+			// Without a level area, the floor covers the building outline.
+			name:   "1",
+			coords: models.Coords{North: 49.2610, South: 49.2600, East: -123.2490, West: -123.2500},
+			rooms: []models.Room{
+				{Id: "110", Type: "restroom", Position: &models.LatLng{Lat: 49.2605, Lng: -123.2495}},
+			},
+		},
+	}
+	if len(b.Floors) != len(want) {
+		t.Fatalf("got %d floors, want %d", len(b.Floors), len(want))
+	}
+	for i, w := range want {
+		f := b.Floors[i]
+		if f.Name != w.name {
+			t.Errorf("floor %d: got name %q, want %q", i, f.Name, w.name)
+			continue
+		}
+		c := f.Coords
+		if c == nil || !approx(c.North, w.coords.North) || !approx(c.South, w.coords.South) ||
+			!approx(c.East, w.coords.East) || !approx(c.West, w.coords.West) {
+			t.Errorf("floor %s: got coords %+v, want %+v", w.name, c, w.coords)
+		}
+		if len(f.Rooms) != len(w.rooms) {
+			t.Errorf("floor %s: got %d rooms, want %d", w.name, len(f.Rooms), len(w.rooms))
+			continue
+		}
+		for j, r := range f.Rooms {
+			wr := w.rooms[j]
+			if r.Id != wr.Id || r.Name != wr.Name || r.Type != wr.Type || r.SIS != "TST" || r.Floor != w.name || !near(r.Position, wr.Position) {
+				t.Errorf("floor %s: got room %+v at %+v, want %+v at %+v", w.name, r, r.Position, wr, wr.Position)
+			}
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	buildings := []*models.Building{{
+		SIS: "TST",
+		Floors: []*models.Floor{{
+			Name: "1",
+			Rooms: []*models.Room{
+				{Id: "110", Type: "restroom", Position: &models.LatLng{Lat: 49.2605, Lng: -123.2495}},
+				{Id: "111"},
+			},
+		}},
+	}}
+	var buf bytes.Buffer
+	if err := Write(&buf, buildings); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`k="indoor" v="room"`, `k="level" v="1"`, `k="ref" v="110"`, `k="amenity" v="toilets"`} {
+		if !bytes.Contains(buf.Bytes(), []byte(s)) {
+			t.Errorf("output is missing %s:\n%s", s, buf.String())
+		}
+	}
+	if bytes.Contains(buf.Bytes(), []byte(`v="111"`)) {
+		t.Errorf("room without a position was written:\n%s", buf.String())
+	}
+}
+
+func approx(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func near(a, b *models.LatLng) bool {
+	return a != nil && b != nil && approx(a.Lat, b.Lat) && approx(a.Lng, b.Lng)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/d4l3k/campus/mbtiles"
+	"github.com/d4l3k/campus/models"
+)
+
+// mbtilesBatch is how many tiles are written to MBTiles per transaction.
+const mbtilesBatch = 64
+
+// openMBTiles opens the prerendered tiles to serve from.
+func (s *Server) openMBTiles(path string) error {
+	tiles, err := mbtiles.Open(path)
+	if err != nil {
+		return err
+	}
+	scale, err := tiles.Scale()
+	if err != nil {
+		tiles.Close()
+		return err
+	}
+	format, err := tiles.Metadata("format")
+	if err != nil {
+		tiles.Close()
+		return err
+	}
+	if len(format) == 0 {
+		format = FormatPNG
+	}
+	s.mbtiles = tiles
+	s.mbtilesScale = scale
+	s.mbtilesFormat = format
+	return nil
+}
+
+// floorTileRequests returns a request for every tile covering a floor between
+// the zoom levels.
+func floorTileRequests(buildings []*models.Building, minZoom, maxZoom, scale int, format string) []*MapTileRequest {
+	type tileKey struct {
+		z, x, y int
+		floor   string
+	}
+	seen := make(map[tileKey]bool)
+	var reqs []*MapTileRequest
+	for z := minZoom; z <= maxZoom; z++ {
+		for _, b := range buildings {
+			for _, f := range b.Floors {
+				if f.Coords == nil || len(f.Image) == 0 {
+					continue
+				}
+				minX, minY := pointToTile(f.Coords.North, f.Coords.West, z)
+				maxX, maxY := pointToTile(f.Coords.South, f.Coords.East, z)
+				for x := minX; x <= maxX; x++ {
+					for y := minY; y <= maxY; y++ {
+						key := tileKey{z, x, y, f.Name}
+						if seen[key] {
+							continue
+						}
+						seen[key] = true
+						reqs = append(reqs, &MapTileRequest{X: x, Y: y, Z: z, Floor: f.Name, Scale: scale, Format: format})
+					}
+				}
+			}
+		}
+	}
+	return reqs
+}
+
+// prerenderCommand renders the tiles of every floor ahead of time into the
+// tile directory or an MBTiles file. Tiles that already exist are skipped, so
+// an interrupted run can be resumed. Tiles that fail to render are logged and
+// left for the server to retry.
+func prerenderCommand(args []string) error {
+	fs := flag.NewFlagSet("prerender", flag.ExitOnError)
+	minZoom := fs.Int("minzoom", 15, "the lowest zoom level to render")
+	maxZoom := fs.Int("maxzoom", 21, "the highest zoom level to render")
+	scale := fs.Int("scale", 1, "the tile scale, e.g. 2 for @2x tiles")
+	format := fs.String("format", FormatPNG, "the tile format; png or webp")
+	workers := fs.Int("workers", runtime.NumCPU(), "the number of tiles to render at once")
+	out := fs.String("mbtiles", "", "the MBTiles file to write to; defaults to the tile directory")
+	force := fs.Bool("force", false, "render tiles again even if they exist")
+	fs.Parse(args)
+
+	if *minZoom < 0 || *maxZoom > MaxZoom || *minZoom > *maxZoom {
+		return fmt.Errorf("invalid zoom range %d-%d", *minZoom, *maxZoom)
+	}
+	if _, ok := blankTiles[*scale]; !ok {
+		return fmt.Errorf("unsupported tile scale %d", *scale)
+	}
+	if _, ok := blankTiles[*scale][*format]; !ok {
+		return fmt.Errorf("unsupported tile format %q", *format)
+	}
+
+	store, err := models.LoadStore()
+	if err != nil {
+		return err
+	}
+	s := &Server{store: store}
+	s.initCache()
+
+	var tiles *mbtiles.Tiles
+	if len(*out) > 0 {
+		if tiles, err = mbtiles.Open(*out); err != nil {
+			return err
+		}
+		defer tiles.Close()
+		for name, value := range map[string]string{
+			"name":    *venueName,
+			"type":    "overlay",
+			"format":  *format,
+			"scale":   strconv.Itoa(*scale),
+			"minzoom": strconv.Itoa(*minZoom),
+			"maxzoom": strconv.Itoa(*maxZoom),
+		} {
+			if err := tiles.SetMetadata(name, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	// exists reports whether a tile was rendered by a previous run.
+	exists := func(req *MapTileRequest) (bool, error) {
+		if tiles != nil {
+			return tiles.Has(req.Z, req.X, req.Y, req.Floor)
+		}
+		_, err := os.Stat(tilePath(req.Z, req.X, req.Y, req.Floor, req.Scale, req.Format))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	reqs := floorTileRequests(store.Buildings(), *minZoom, *maxZoom, *scale, *format)
+	log.Printf("Prerendering %d tiles at zoom levels %d-%d...", len(reqs), *minZoom, *maxZoom)
+
+	var done, skipped, blanks, failed int64
+	start := time.Now()
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	go func() {
+		for range ticker.C {
+			n := atomic.LoadInt64(&done)
+			log.Printf("Prerendered %d/%d tiles (%d skipped, %d blank, %d failed, %s elapsed)", n, len(reqs), atomic.LoadInt64(&skipped), atomic.LoadInt64(&blanks), atomic.LoadInt64(&failed), time.Since(start))
+		}
+	}()
+
+	// The first error storing tiles stops the run, after the tiles in flight
+	// are written.
+	var firstErr error
+	var errOnce sync.Once
+	stop := make(chan struct{})
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			close(stop)
+		})
+	}
+
+	reqc := make(chan *MapTileRequest)
+	results := make(chan *mbtiles.Tile)
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range reqc {
+				if !*force {
+					ok, err := exists(req)
+					if err != nil {
+						fail(err)
+						continue
+					}
+					if ok {
+						atomic.AddInt64(&skipped, 1)
+						atomic.AddInt64(&done, 1)
+						continue
+					}
+				}
+				data, blank, err := s.renderTile(req)
+				if err != nil {
+					log.Printf("Failed to render tile %+v: %s", req, err)
+					atomic.AddInt64(&failed, 1)
+					atomic.AddInt64(&done, 1)
+					continue
+				}
+				// Like the server, don't write blank tiles to the tile
+				// directory.
+				if blank && tiles == nil {
+					atomic.AddInt64(&blanks, 1)
+					atomic.AddInt64(&done, 1)
+					continue
+				}
+				results <- &mbtiles.Tile{Z: req.Z, X: req.X, Y: req.Y, Floor: req.Floor, Data: data}
+			}
+		}()
+	}
+	go func() {
+		defer close(reqc)
+		for _, req := range reqs {
+			select {
+			case reqc <- req:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// write stores rendered tiles, batching them for MBTiles.
+	var batch []*mbtiles.Tile
+	write := func(tile *mbtiles.Tile) error {
+		if tiles == nil {
+			path := tilePath(tile.Z, tile.X, tile.Y, tile.Floor, *scale, *format)
+			if err := ioutil.WriteFile(path, tile.Data, 0755); err != nil {
+				return err
+			}
+			atomic.AddInt64(&done, 1)
+			return nil
+		}
+		if tile != nil {
+			batch = append(batch, tile)
+			if len(batch) < mbtilesBatch {
+				return nil
+			}
+		}
+		if err := tiles.Put(batch...); err != nil {
+			return err
+		}
+		atomic.AddInt64(&done, int64(len(batch)))
+		batch = nil
+		return nil
+	}
+	for tile := range results {
+		if err := write(tile); err != nil {
+			fail(err)
+		}
+	}
+	if len(batch) > 0 {
+		if err := write(nil); err != nil {
+			fail(err)
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	log.Printf("Prerendered %d tiles (%d skipped, %d blank, %d failed) in %s", done, skipped, blanks, failed, time.Since(start))
+	return nil
+}
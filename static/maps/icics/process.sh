@@ -1 +0,0 @@
-convert -density 150 -trim -background white -alpha remove -rotate 62 -fuzz 5% -fill none -floodfill +0+0 white  -trim all-levels.pdf page_%04d.png
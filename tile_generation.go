@@ -13,113 +13,327 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 
-	"github.com/BurntSushi/graphics-go/graphics"
+	"github.com/chai2010/webp"
 	"github.com/d4l3k/campus/models"
 	"github.com/golang/groupcache"
 	"github.com/gorilla/mux"
-	"github.com/nfnt/resize"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
 )
 
 const TileWorkers = 4
 
-var tileEncoder = &png.Encoder{CompressionLevel: png.NoCompression}
-var blankTile []byte
+// MaxZoom is the highest zoom level tiles are rendered at.
+const MaxZoom = 22
+
+// Tile formats.
+const (
+	FormatPNG  = "png"
+	FormatWebP = "webp"
+)
+
+// tileScales are the supported tile scales, e.g. 2 for @2x tiles.
+var tileScales = []int{1, 2}
+
+// tileFormats are the supported tile image formats.
+var tileFormats = []string{FormatPNG, FormatWebP}
+
+// blankTiles are the empty tiles by scale and format.
+var blankTiles = make(map[int]map[string][]byte)
 
 func init() {
-	img := image.NewNRGBA(image.Rect(0, 0, TileSize, TileSize))
+	for _, scale := range tileScales {
+		blankTiles[scale] = make(map[string][]byte)
+		size := TileSize * scale
+		img := image.NewNRGBA(image.Rect(0, 0, size, size))
+		var buf bytes.Buffer
+		if err := (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img); err != nil {
+			log.Fatal(err)
+		}
+		blankTiles[scale][FormatPNG] = buf.Bytes()
+		buf.Reset()
+		if err := webp.Encode(&buf, img, &webp.Options{Lossless: true}); err != nil {
+			log.Fatal(err)
+		}
+		blankTiles[scale][FormatWebP] = buf.Bytes()
+	}
+}
 
+// encodeTile encodes a tile image in the format.
+func encodeTile(img image.Image, format string) ([]byte, error) {
 	var buf bytes.Buffer
-	if err := (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img); err != nil {
-		log.Fatal(err)
+	var err error
+	switch format {
+	case FormatPNG:
+		err = png.Encode(&buf, img)
+	case FormatWebP:
+		err = webp.Encode(&buf, img, &webp.Options{Lossless: true})
+	default:
+		err = fmt.Errorf("unknown tile format %q", format)
+	}
+	if err != nil {
+		return nil, err
 	}
-	blankTile = buf.Bytes()
+	return buf.Bytes(), nil
 }
 
-type zoomedImageGetter struct {
+// floorTileGetter renders the tiles of each floor's image pyramid. Each tile
+// only samples the pixels it covers of the smallest level of the pyramid with
+// enough detail for its zoom. Tiles are cached as raw premultiplied RGBA pixels
+// so they can be composited without decoding.
+type floorTileGetter struct {
 	s *Server
 }
 
-func newImageDimentions(img draw.Image, angle float64) (int, int) {
-	bounds := img.Bounds()
-	width := float64(bounds.Max.X - bounds.Min.X)
-	height := float64(bounds.Max.Y - bounds.Min.Y)
-
-	w, h := newDimentions(width, height, angle)
-	return int(w), int(h)
-}
+func (g floorTileGetter) Get(ctx groupcache.Context, key string, dest groupcache.Sink) error {
+	bft := &BuildingFloorTile{}
+	if err := json.Unmarshal([]byte(key), bft); err != nil {
+		return err
+	}
 
-func newDimentions(width, height, angle float64) (float64, float64) {
-	affine := graphics.I.Rotate(angle)
-	rotated := affine.Mul(graphics.Affine{
-		width, width, 0,
-		height, 0, height,
-		1, 1, 1,
-	})
-	log.Printf("Rotation matrix %+v", rotated)
+	floor := g.s.GetBuildingFloor(bft.Building, bft.Floor)
+	if floor == nil {
+		return fmt.Errorf("floor %s of %s not found", bft.Floor, bft.Building)
+	}
 
-	// Compute new bounding coordinates
-	left := math.Min(math.Min(0, rotated[0]), math.Min(rotated[1], rotated[2]))
-	right := math.Max(math.Max(0, rotated[0]), math.Max(rotated[1], rotated[2]))
-	bottom := math.Min(math.Min(0, rotated[3]), math.Min(rotated[4], rotated[5]))
-	top := math.Max(math.Max(0, rotated[3]), math.Max(rotated[4], rotated[5]))
+	size := TileSize * bft.Scale
+	var tile *image.RGBA
+	if floor.IsSVG() {
+		icon, err := floor.SourceSVG()
+		if err != nil {
+			return err
+		}
+		tile = renderSVGFloorTile(floor, icon, bft.Z, bft.X, bft.Y, size)
+	} else {
+		img, err := floorTileSource(floor, bft.Z, bft.X, bft.Y, size)
+		if err != nil {
+			return err
+		}
+		tile = renderFloorTile(floor, img, bft.Z, bft.X, bft.Y, size)
+	}
 
-	return (math.Abs(right - left)), (math.Abs(top - bottom))
+	return dest.SetBytes(tile.Pix)
 }
 
-func (g zoomedImageGetter) Get(ctx groupcache.Context, key string, dest groupcache.Sink) error {
-	bfz := &BuildingFloorZoom{}
-	if err := json.Unmarshal([]byte(key), bfz); err != nil {
-		return err
+// floorToTile returns the transform from a floor image that is w by h to the
+// pixels of a tile that is size pixels wide. Floors georeferenced by control
+// points use their fitted transform. Otherwise the image is rotated clockwise
+// about its center so that its bounding box exactly fills the floor's
+// coordinates. The tile is small enough to treat as linear in latitude.
+func floorToTile(floor *models.Floor, w, h float64, z, x, y, size int) rasterx.Matrix2D {
+	north, west := tileFractionToLatLng(float64(x), float64(y), z)
+	south, east := tileFractionToLatLng(float64(x+1), float64(y+1), z)
+	sx, sy := float64(size)/(east-west), float64(size)/(north-south)
+	toTile := rasterx.Matrix2D{A: sx, D: -sy, E: -west * sx, F: north * sy}
+
+	if t := floor.Transform; t != nil {
+		toLatLng := rasterx.Matrix2D{A: t.A, B: t.D, C: t.B, D: t.E, E: t.C, F: t.F}
+		toRel := rasterx.Matrix2D{A: 1 / w, D: 1 / h}
+		return toTile.Mult(toLatLng).Mult(toRel)
 	}
 
-	floor := g.s.GetBuildingFloor(bfz.Building, bfz.Floor)
-	var err error
-	floor.ImageOnce.Do(func() {
-		var img, origImg draw.Image
-		floor.ImageWG.Add(1)
-		defer floor.ImageWG.Done()
-		origImg, err = floor.LoadImage()
-		if err != nil {
-			return
-		}
+	sin, cos := math.Sincos(floor.Rotation)
+	rw := math.Abs(w*cos) + math.Abs(h*sin)
+	rh := math.Abs(w*sin) + math.Abs(h*cos)
+	coords := floor.Coords
+	toLatLng := rasterx.Matrix2D{
+		A: coords.DLng() / rw,
+		D: -coords.DLat() / rh,
+		E: coords.West + coords.DLng()/2,
+		F: coords.North - coords.DLat()/2,
+	}
+	rotate := rasterx.Matrix2D{A: cos, B: sin, C: -sin, D: cos}
+	center := rasterx.Matrix2D{A: 1, D: 1, E: -w / 2, F: -h / 2}
+	return toTile.Mult(toLatLng).Mult(rotate).Mult(center)
+}
 
-		img = origImg
+// floorTileSource returns the smallest level of the floor's image pyramid
+// that still has at least one pixel for each pixel of a tile that is size
+// pixels wide, so low zoom levels don't sample from the full size image.
+func floorTileSource(floor *models.Floor, z, x, y, size int) (image.Image, error) {
+	img, err := floor.SourceImage()
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	m := floorToTile(floor, float64(bounds.Dx()), float64(bounds.Dy()), z, x, y, size).Invert()
+	// The number of source pixels between neighbouring tile pixels.
+	step := math.Min(math.Hypot(m.A, m.B), math.Hypot(m.C, m.D))
+	level := 0
+	for ; step >= 2; step /= 2 {
+		level++
+	}
+	return floor.SourceLevel(level)
+}
 
-		if floor.Rotation != 0 {
-			rotatedWidth, rotatedHeight := newImageDimentions(origImg, floor.Rotation)
-			img = image.NewNRGBA64(image.Rect(0, 0, rotatedWidth, rotatedHeight))
-			if err = graphics.Rotate(img, origImg, &graphics.RotateOptions{Angle: floor.Rotation}); err != nil {
-				return
+// renderFloorTile renders the part of the floor image within a tile that is
+// size pixels wide. Each tile pixel is mapped back to the nearest pixel of src,
+// which is the floor image or one of its downsampled levels.
+func renderFloorTile(floor *models.Floor, src image.Image, z, x, y, size int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	bounds := src.Bounds()
+	m := floorToTile(floor, float64(bounds.Dx()), float64(bounds.Dy()), z, x, y, size).Invert()
+	sample := pixelSampler(src)
+	for py := 0; py < size; py++ {
+		row := dst.Pix[py*dst.Stride : py*dst.Stride+4*size]
+		// The transform is affine, so the source position steps linearly along
+		// each row.
+		sx, sy := m.Transform(0.5, float64(py)+0.5)
+		for px := 0; px < size; px++ {
+			ix, iy := int(math.Floor(sx)), int(math.Floor(sy))
+			if ix >= 0 && ix < bounds.Dx() && iy >= 0 && iy < bounds.Dy() {
+				sample(row[4*px:4*px+4], bounds.Min.X+ix, bounds.Min.Y+iy)
 			}
+			sx += m.A
+			sy += m.B
 		}
-		floor.RotatedImage = img
-	})
-	floor.ImageWG.Wait()
-	if err != nil {
-		return err
 	}
+	return dst
+}
 
-	img := floor.RotatedImage
+// pixelSampler returns a function that copies the pixel of src at x, y into
+// p as premultiplied RGBA. The common image types are read directly rather
+// than through At, which allocates.
+func pixelSampler(src image.Image) func(p []uint8, x, y int) {
+	switch src := src.(type) {
+	case *image.RGBA:
+		return func(p []uint8, x, y int) {
+			i := src.PixOffset(x, y)
+			copy(p, src.Pix[i:i+4])
+		}
+	case *image.NRGBA:
+		return func(p []uint8, x, y int) {
+			i := src.PixOffset(x, y)
+			s := src.Pix[i : i+4 : i+4]
+			// Premultiply the same way as color.NRGBA.RGBA.
+			a := uint32(s[3]) * 0x101
+			p[0] = uint8(uint32(s[0]) * 0x101 * a / 0xffff >> 8)
+			p[1] = uint8(uint32(s[1]) * 0x101 * a / 0xffff >> 8)
+			p[2] = uint8(uint32(s[2]) * 0x101 * a / 0xffff >> 8)
+			p[3] = s[3]
+		}
+	case *image.NRGBA64:
+		return func(p []uint8, x, y int) {
+			i := src.PixOffset(x, y)
+			s := src.Pix[i : i+8 : i+8]
+			// Premultiply the same way as color.NRGBA64.RGBA.
+			a := uint32(s[6])<<8 | uint32(s[7])
+			p[0] = uint8((uint32(s[0])<<8 | uint32(s[1])) * a / 0xffff >> 8)
+			p[1] = uint8((uint32(s[2])<<8 | uint32(s[3])) * a / 0xffff >> 8)
+			p[2] = uint8((uint32(s[4])<<8 | uint32(s[5])) * a / 0xffff >> 8)
+			p[3] = s[6]
+		}
+	default:
+		return func(p []uint8, x, y int) {
+			r, g, b, a := src.At(x, y).RGBA()
+			p[0], p[1], p[2], p[3] = uint8(r>>8), uint8(g>>8), uint8(b>>8), uint8(a>>8)
+		}
+	}
+}
 
-	coords := ctx.(*models.Coords)
-	pixelsPerLongitude := TileSize / coords.DLng()
-	pixelsPerLatitude := TileSize / coords.DLat()
-	newWidth := floor.Coords.DLng() * pixelsPerLongitude
-	newHeight := floor.Coords.DLat() * pixelsPerLatitude
+// renderSVGFloorTile rasterizes the part of a vector floor plan within a tile
+// that is size pixels wide, so it stays sharp at every zoom level. Only the
+// floor's footprint within the tile is drawn.
+func renderSVGFloorTile(floor *models.Floor, icon *oksvg.SvgIcon, z, x, y, size int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	vb := icon.ViewBox
+	m := floorToTile(floor, vb.W, vb.H, z, x, y, size).Translate(-vb.X, -vb.Y)
+
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, corner := range [][2]float64{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+		cx, cy := m.Transform(vb.X+corner[0]*vb.W, vb.Y+corner[1]*vb.H)
+		minX, minY = math.Min(minX, cx), math.Min(minY, cy)
+		maxX, maxY = math.Max(maxX, cx), math.Max(maxY, cy)
+	}
+	footprint := image.Rect(
+		int(math.Floor(minX)), int(math.Floor(minY)),
+		int(math.Ceil(maxX)), int(math.Ceil(maxY)),
+	).Intersect(dst.Bounds())
+	if footprint.Empty() {
+		return dst
+	}
 
-	log.Printf("Generating resized image %f %f", newWidth, newHeight)
+	sub := image.NewRGBA(image.Rect(0, 0, footprint.Dx(), footprint.Dy()))
+	shift := rasterx.Matrix2D{A: 1, D: 1, E: float64(-footprint.Min.X), F: float64(-footprint.Min.Y)}
+	models.DrawSVG(sub, icon, shift.Mult(m))
+	draw.Draw(dst, footprint, sub, image.ZP, draw.Src)
+	return dst
+}
 
-	resizedImg := resize.Resize(uint(newWidth), uint(newHeight), img, resize.NearestNeighbor)
-	var buf bytes.Buffer
-	if err := tileEncoder.Encode(&buf, resizedImg); err != nil {
-		return err
+// tilePath returns the path a rendered tile is stored at.
+func tilePath(z, x, y int, floor string, scale int, format string) string {
+	suffix := ""
+	if scale != 1 {
+		suffix = fmt.Sprintf("@%dx", scale)
+	}
+	return fmt.Sprintf("static/api/tiles/%d_%d_%d_%s%s.%s", z, x, y, floor, suffix, format)
+}
+
+// tileRange is the tiles covering a floor at MaxZoom.
+type tileRange struct {
+	floor                  string
+	minX, minY, maxX, maxY int
+}
+
+// floorTileRanges returns the tiles covering each floor of the building.
+func floorTileRanges(b *models.Building) []tileRange {
+	var ranges []tileRange
+	for _, f := range b.Floors {
+		if f.Coords == nil {
+			continue
+		}
+		minX, minY := pointToTile(f.Coords.North, f.Coords.West, MaxZoom)
+		maxX, maxY := pointToTile(f.Coords.South, f.Coords.East, MaxZoom)
+		ranges = append(ranges, tileRange{f.Name, minX, minY, maxX, maxY})
+	}
+	return ranges
+}
+
+// removeTiles removes the rendered tiles of the ranges at every zoom level so
+// they're rendered again. It can take a while for large floors, so it
+// shouldn't be called with the server locked.
+func (s *Server) removeTiles(ranges []tileRange) {
+	for _, r := range ranges {
+		if s.mbtiles != nil {
+			if err := s.mbtiles.DeleteRange(MaxZoom, r.minX, r.maxX, r.minY, r.maxY, r.floor); err != nil {
+				log.Printf("Failed to remove tiles: %s", err)
+			}
+		}
+		for z := 0; z <= MaxZoom; z++ {
+			// Tiles at lower zoom levels cover 2^shift tiles at MaxZoom.
+			shift := uint(MaxZoom - z)
+			for x := r.minX >> shift; x <= r.maxX>>shift; x++ {
+				for y := r.minY >> shift; y <= r.maxY>>shift; y++ {
+					for _, scale := range tileScales {
+						for _, format := range tileFormats {
+							err := os.Remove(tilePath(z, x, y, r.floor, scale, format))
+							if err != nil && !os.IsNotExist(err) {
+								log.Printf("Failed to remove tile: %s", err)
+							}
+						}
+					}
+				}
+			}
+		}
 	}
-	return dest.SetBytes(buf.Bytes())
 }
 
+// generateTile returns a tile from the prerendered MBTiles or tile directory,
+// rendering and storing it in the directory if it's missing.
 func (s *Server) generateTile(req *MapTileRequest) ([]byte, error) {
-	url := fmt.Sprintf("static/api/tiles/%d_%d_%d_%s.png", req.Z, req.X, req.Y, req.Floor)
+	if s.mbtiles != nil && !*debug && req.Scale == s.mbtilesScale && req.Format == s.mbtilesFormat {
+		data, err := s.mbtiles.Get(req.Z, req.X, req.Y, req.Floor)
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			return data, nil
+		}
+	}
+	url := tilePath(req.Z, req.X, req.Y, req.Floor, req.Scale, req.Format)
 	if _, err := os.Stat(url); err == nil {
 		if *debug {
 			log.Printf("file exists, but not serving due to debug; %s", url)
@@ -127,9 +341,22 @@ func (s *Server) generateTile(req *MapTileRequest) ([]byte, error) {
 			return ioutil.ReadFile(url)
 		}
 	}
+	log.Printf("Map tile req %+v", req)
+	bytes, blank, err := s.renderTile(req)
+	if err != nil || blank {
+		return bytes, err
+	}
+	if err := ioutil.WriteFile(url, bytes, 0755); err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+// renderTile draws the floors overlapping the tile. blank is whether there
+// were no buildings to draw.
+func (s *Server) renderTile(req *MapTileRequest) (tile []byte, blank bool, err error) {
 	point := tileToPoint(req.X, req.Y, req.Z)
 	pointBottom := tileToPoint(req.X+1, req.Y+1, req.Z)
-	log.Printf("Map tile req %+v %+v %+v", req, point, pointBottom)
 	coords := &models.Coords{
 		North: point.Lat(),
 		South: pointBottom.Lat(),
@@ -139,55 +366,53 @@ func (s *Server) generateTile(req *MapTileRequest) ([]byte, error) {
 	buildings := s.OverlappingBuildings(coords)
 
 	if len(buildings) == 0 {
-		return blankTile, nil
+		return blankTiles[req.Scale][req.Format], true, nil
 	}
 
-	m := image.NewNRGBA(image.Rect(0, 0, TileSize, TileSize))
+	size := TileSize * req.Scale
+	m := image.NewRGBA(image.Rect(0, 0, size, size))
 	for _, building := range buildings {
 		for _, floor := range building.Floors {
-			if floor.Name != req.Floor {
+			if floor.Name != req.Floor || len(floor.Image) == 0 || floor.Coords == nil || !coords.Overlap(floor.Coords) {
 				continue
 			}
-			bfz := &BuildingFloorZoom{building.Name, floor.Name, req.Z}
-			buf, err := json.Marshal(bfz)
+			bft := &BuildingFloorTile{building.Name, floor.Name, building.Version, req.Z, req.X, req.Y, req.Scale}
+			buf, err := json.Marshal(bft)
 			if err != nil {
-				return nil, err
+				return nil, false, err
 			}
 			var resp []byte
-			if err := s.zoomedFloorCache.Get(coords, string(buf), groupcache.AllocatingByteSliceSink(&resp)); err != nil {
-				return nil, err
+			if err := s.floorTileCache.Get(nil, string(buf), groupcache.AllocatingByteSliceSink(&resp)); err != nil {
+				return nil, false, err
 			}
-			resizedImg, _, err := image.Decode(bytes.NewBuffer(resp))
-			if err != nil {
-				return nil, err
+			if len(resp) != len(m.Pix) {
+				return nil, false, fmt.Errorf("floor tile %s has %d bytes, want %d", buf, len(resp), len(m.Pix))
 			}
-			rect := resizedImg.Bounds()
-			x := float64(rect.Dx()) - float64(rect.Dx())/(floor.Coords.East-floor.Coords.West)*(floor.Coords.East-coords.East) - TileSize
-			y := float64(rect.Dy()) / (floor.Coords.North - floor.Coords.South) * (floor.Coords.North - coords.North)
-			sp := image.Pt(int(x), int(y))
-			draw.Draw(m, image.Rect(0, 0, TileSize, TileSize), resizedImg, sp, draw.Over)
+			floorTile := &image.RGBA{Pix: resp, Stride: m.Stride, Rect: m.Rect}
+			draw.Draw(m, m.Bounds(), floorTile, image.ZP, draw.Over)
 		}
 	}
 
-	var buf bytes.Buffer
-	if err := png.Encode(&buf, m); err != nil {
-		return nil, err
-	}
-	bytes := buf.Bytes()
-	if err := ioutil.WriteFile(url, bytes, 0755); err != nil {
-		return nil, err
-	}
-	return bytes, nil
+	tile, err = encodeTile(m, req.Format)
+	return tile, false, err
 }
 
-type BuildingFloorZoom struct {
+// BuildingFloorTile is the cache key of a tile of a floor's image pyramid.
+// The building version ensures edited floors aren't served stale.
+type BuildingFloorTile struct {
 	Building, Floor string
-	Zoom            int
+	Version         int
+	Z, X, Y         int
+	Scale           int
 }
 
 type MapTileRequest struct {
 	X, Y, Z int
 	Floor   string
+	// Scale is the tile size multiple, e.g. 2 for 512px @2x tiles.
+	Scale int
+	// Format is the tile image format.
+	Format string
 
 	resp chan []byte
 	err  chan error
@@ -211,6 +436,19 @@ func (s *Server) tileWorker() {
 	}
 }
 
+// checkTile returns an error if the tile isn't one of the tiles at zoom levels
+// 0 to MaxZoom. Only those are removed from the caches after edits, so no
+// others may be cached.
+func checkTile(z, x, y int) error {
+	if z < 0 || z > MaxZoom {
+		return fmt.Errorf("zoom %d is outside of 0 to %d", z, MaxZoom)
+	}
+	if n := 1 << uint(z); x < 0 || x >= n || y < 0 || y >= n {
+		return fmt.Errorf("tile %d, %d is outside of zoom %d", x, y, z)
+	}
+	return nil
+}
+
 func (s *Server) tiles(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	z, err := strconv.Atoi(vars["zoom"])
@@ -228,10 +466,26 @@ func (s *Server) tiles(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), 400)
 		return
 	}
+	if err := checkTile(z, x, y); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
 	floorName := vars["floor"]
+	scale := 1
+	if len(vars["scale"]) > 0 {
+		scale, err = strconv.Atoi(vars["scale"])
+		if err != nil || scale != 2 {
+			http.Error(w, "unsupported tile scale", 400)
+			return
+		}
+	}
+	format := FormatPNG
+	if strings.Contains(r.Header.Get("Accept"), "image/webp") {
+		format = FormatWebP
+	}
 
 	req := &MapTileRequest{
-		x, y, z, floorName,
+		x, y, z, floorName, scale, format,
 		make(chan []byte, 1),
 		make(chan error, 1),
 	}
@@ -244,7 +498,8 @@ func (s *Server) tiles(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), 500)
 		return
 	case resp := <-req.resp:
-		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Type", "image/"+format)
+		w.Header().Set("Vary", "Accept")
 		if _, err := w.Write(resp); err != nil {
 			http.Error(w, err.Error(), 500)
 			return
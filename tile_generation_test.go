@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/d4l3k/campus/models"
+	"github.com/gorilla/mux"
+	"github.com/nfnt/resize"
+)
+
+// TestTilesOutOfRange checks that tiles that wouldn't be removed from the
+// caches after an edit are rejected before they're rendered.
+func TestTilesOutOfRange(t *testing.T) {
+	cases := []struct{ z, x, y string }{
+		{"-1", "0", "0"},
+		{"23", "0", "0"},
+		{"100", "0", "0"},
+		{"2", "4", "0"},
+		{"2", "0", "4"},
+		{"2", "-1", "0"},
+		{"0", "0", "1"},
+	}
+	for _, c := range cases {
+		vars := map[string]string{"zoom": c.z, "x": c.x, "y": c.y, "floor": "1"}
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/api/tiles/", nil), vars)
+		w := httptest.NewRecorder()
+		testServer.tiles(w, r)
+		if w.Code != 400 {
+			t.Errorf("tile %s/%s/%s: got status %d, want 400", c.z, c.x, c.y, w.Code)
+		}
+	}
+	for _, tile := range [][3]int{{0, 0, 0}, {2, 3, 3}, {MaxZoom, 1<<MaxZoom - 1, 0}} {
+		if err := checkTile(tile[0], tile[1], tile[2]); err != nil {
+			t.Errorf("tile %v: %s", tile, err)
+		}
+	}
+}
+
+// benchmarkZooms are the zoom levels floor tiles are benchmarked at.
+var benchmarkZooms = []int{17, 19, 21}
+
+// benchmarkFloor returns the largest bundled raster floor plan and its image.
+func benchmarkFloor(b *testing.B) (*models.Floor, image.Image) {
+	var floor *models.Floor
+	if building := testServer.store.Building("ICCS"); building != nil {
+		for _, f := range building.Floors {
+			if f.Name == "2" {
+				floor = f
+			}
+		}
+	}
+	if floor == nil {
+		b.Fatal("floor 2 of ICCS not found")
+	}
+	img, err := floor.SourceImage()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return floor, img
+}
+
+// centerTile returns the tile at the center of the floor.
+func centerTile(floor *models.Floor, z int) (int, int) {
+	return pointToTile((floor.Coords.North+floor.Coords.South)/2, (floor.Coords.East+floor.Coords.West)/2, z)
+}
+
+// BenchmarkRenderFloorTile renders a single tile of a floor, which only
+// samples the pixels it covers of a level of the floor's image pyramid. The
+// levels are built before the benchmark, since they're only built once.
+func BenchmarkRenderFloorTile(b *testing.B) {
+	floor, _ := benchmarkFloor(b)
+	for _, z := range benchmarkZooms {
+		b.Run(fmt.Sprintf("z=%d", z), func(b *testing.B) {
+			x, y := centerTile(floor, z)
+			img, err := floorTileSource(floor, z, x, y, TileSize)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				renderFloorTile(floor, img, z, x, y, TileSize)
+			}
+		})
+	}
+}
+
+// BenchmarkResizeWholeFloor renders a tile of a floor the way the server used
+// to, as the baseline for BenchmarkRenderFloorTile. The whole floor image was
+// resized to the zoom level and encoded as a PNG, once per zoom level, and
+// then that PNG was decoded again for every tile. The benchmark floor isn't
+// rotated, so this leaves out the rotation, which was only done once per floor.
+func BenchmarkResizeWholeFloor(b *testing.B) {
+	floor, img := benchmarkFloor(b)
+	if floor.Rotation != 0 {
+		b.Fatal("the benchmark floor is rotated")
+	}
+	encoder := &png.Encoder{CompressionLevel: png.NoCompression}
+	for _, z := range benchmarkZooms {
+		b.Run(fmt.Sprintf("z=%d", z), func(b *testing.B) {
+			x, y := centerTile(floor, z)
+			north, west := tileFractionToLatLng(float64(x), float64(y), z)
+			south, east := tileFractionToLatLng(float64(x+1), float64(y+1), z)
+			coords := floor.Coords
+			newWidth := coords.DLng() * TileSize / (east - west)
+			newHeight := coords.DLat() * TileSize / (north - south)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				resized := resize.Resize(uint(newWidth), uint(newHeight), img, resize.NearestNeighbor)
+				var buf bytes.Buffer
+				if err := encoder.Encode(&buf, resized); err != nil {
+					b.Fatal(err)
+				}
+
+				decoded, _, err := image.Decode(&buf)
+				if err != nil {
+					b.Fatal(err)
+				}
+				rect := decoded.Bounds()
+				sx := float64(rect.Dx()) - float64(rect.Dx())/coords.DLng()*(coords.East-east) - TileSize
+				sy := float64(rect.Dy()) / coords.DLat() * (coords.North - north)
+				m := image.NewNRGBA(image.Rect(0, 0, TileSize, TileSize))
+				draw.Draw(m, m.Bounds(), decoded, image.Pt(int(sx), int(sy)), draw.Over)
+			}
+		})
+	}
+}
+
+// BenchmarkRenderTile composites a tile from the cached floor tiles, as the
+// server does for every tile after the first.
+func BenchmarkRenderTile(b *testing.B) {
+	floor, _ := benchmarkFloor(b)
+	testServer.initCache()
+	for _, z := range benchmarkZooms {
+		b.Run(fmt.Sprintf("z=%d", z), func(b *testing.B) {
+			x, y := centerTile(floor, z)
+			req := &MapTileRequest{X: x, Y: y, Z: z, Floor: floor.Name, Scale: 1, Format: FormatPNG}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := testServer.renderTile(req); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -7,13 +7,34 @@ import (
 )
 
 func tileToPoint(x, y, z int) *geo.Point {
-	xf := float64(x)
-	yf := float64(y)
+	lat, long := tileFractionToLatLng(float64(x), float64(y), z)
+	return geo.NewPoint(lat, long)
+}
+
+// tileFractionToLatLng returns the position of the tile coordinates at zoom
+// level z, where the fractions are positions within the tile.
+func tileFractionToLatLng(x, y float64, z int) (float64, float64) {
 	zf := float64(z)
 
-	long := xf/math.Pow(2, zf)*360 - 180
-	n := math.Pi - 2*math.Pi*yf/math.Pow(2, zf)
+	long := x/math.Pow(2, zf)*360 - 180
+	n := math.Pi - 2*math.Pi*y/math.Pow(2, zf)
 	lat := (180 / math.Pi * math.Atan(0.5*(math.Exp(n)-math.Exp(-n))))
 
-	return geo.NewPoint(lat, long)
+	return lat, long
+}
+
+// pointToTile returns the tile containing the point at zoom level z.
+func pointToTile(lat, lng float64, z int) (int, int) {
+	x, y := pointToTileFraction(lat, lng, z)
+	return int(x), int(y)
+}
+
+// pointToTileFraction returns the tile coordinates of the point at zoom level
+// z, with the fraction being its position within the tile.
+func pointToTileFraction(lat, lng float64, z int) (float64, float64) {
+	n := math.Pow(2, float64(z))
+	latRad := lat * math.Pi / 180
+	x := (lng + 180) / 360 * n
+	y := (1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2 * n
+	return x, y
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/d4l3k/campus/geojson"
+	"github.com/d4l3k/campus/models"
+)
+
+var (
+	author  = flag.String("author", "import_geojson", "the author to record the building revisions as")
+	history = flag.String("history", "./history", "the directory to store building revisions in")
+	dryRun  = flag.Bool("dryrun", false, "only print the changes that would be made")
+)
+
+func importFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fc := &geojson.FeatureCollection{}
+	if err := json.NewDecoder(f).Decode(fc); err != nil {
+		return err
+	}
+
+	models.HistoryPath = *history
+	store, err := models.LoadStore()
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		changes, err := geojson.Merge(store.Buildings(), fc, true)
+		if err != nil {
+			return err
+		}
+		for _, c := range changes {
+			fmt.Println(c)
+		}
+		return nil
+	}
+	return store.Edit(*author, func(buildings []*models.Building) ([]string, error) {
+		changes, err := geojson.Merge(buildings, fc, false)
+		if err != nil {
+			return nil, err
+		}
+		var changed []string
+		for _, c := range changes {
+			fmt.Println(c)
+			changed = append(changed, c.SIS)
+		}
+		log.Printf("Saving %d changes...", len(changes))
+		return changed, nil
+	})
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatal("usage: import_geojson [-author name] [-history dir] [-dryrun] <file.geojson>")
+	}
+	if err := importFile(flag.Arg(0)); err != nil {
+		log.Fatal(err)
+	}
+}
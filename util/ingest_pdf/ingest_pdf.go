@@ -0,0 +1,327 @@
+// Command ingest_pdf adds the pages of a floor plan PDF to a building as
+// floors. Pages are rendered with pdftocairo from poppler-utils.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/d4l3k/campus/models"
+)
+
+var (
+	sis    = flag.String("sis", "", "the SIS of the building the floor plans are of")
+	floors = flag.String("floors", "", "comma separated floor names for each page; defaults to the page numbers")
+	format = flag.String("format", "png", "the floor image format; png or svg")
+	dpi    = flag.Int("dpi", 150, "the resolution to render png floor images at")
+	dir    = flag.String("dir", "", "the directory under static to write floor images to; defaults to maps/<sis>")
+	rotate = flag.Float64("rotate", 0, "the clockwise rotation of the floors in degrees")
+	crop   = flag.String("crop", "", "the WxH+X+Y area of each png page to keep, in pixels")
+	clear  = flag.Bool("clear", false, "make the white background around png floor plans transparent")
+	fuzz   = flag.Float64("fuzz", 5, "how far from white in percent the background cleared by -clear can be")
+	author = flag.String("author", "ingest_pdf", "the author to record the building revision as")
+	dryRun = flag.Bool("dryrun", false, "only print the changes that would be made")
+
+	history = flag.String("history", "./history", "the directory to store building revisions in")
+)
+
+// pagesRegexp matches the page count in the output of pdfinfo.
+var pagesRegexp = regexp.MustCompile(`(?m)^Pages:\s+(\d+)`)
+
+// cropRegexp matches an area in the WxH+X+Y geometry format of ImageMagick.
+var cropRegexp = regexp.MustCompile(`^(\d+)x(\d+)\+(\d+)\+(\d+)$`)
+
+// Default size of a new floor, matching the map editor.
+const (
+	defaultLatSpan = 0.001
+	defaultLngSpan = 0.002
+)
+
+// pageCount returns the number of pages in the PDF.
+func pageCount(pdf string) (int, error) {
+	out, err := exec.Command("pdfinfo", pdf).Output()
+	if err != nil {
+		return 0, fmt.Errorf("pdfinfo: %s", err)
+	}
+	m := pagesRegexp.FindSubmatch(out)
+	if m == nil {
+		return 0, fmt.Errorf("pdfinfo: no page count for %s", pdf)
+	}
+	return strconv.Atoi(string(m[1]))
+}
+
+// extractPage renders a page of the PDF to out, which is a .png or .svg file.
+// A png page is cropped to the area, unless it's empty.
+func extractPage(pdf string, page int, out string, area image.Rectangle) error {
+	p := strconv.Itoa(page)
+	var cmd *exec.Cmd
+	if filepath.Ext(out) == ".svg" {
+		cmd = exec.Command("pdftocairo", "-svg", "-f", p, "-l", p, pdf, out)
+	} else {
+		prefix := strings.TrimSuffix(out, ".png")
+		cmd = exec.Command("pdftocairo", "-png", "-transp", "-singlefile", "-r", strconv.Itoa(*dpi), "-f", p, "-l", p, pdf, prefix)
+	}
+	if msg, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pdftocairo: %s: %s", err, bytes.TrimSpace(msg))
+	}
+	if filepath.Ext(out) == ".png" {
+		return processImage(out, area)
+	}
+	return nil
+}
+
+// parseCrop parses an area in the WxH+X+Y geometry format.
+func parseCrop(s string) (image.Rectangle, error) {
+	m := cropRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return image.Rectangle{}, fmt.Errorf("invalid crop %q; want WxH+X+Y", s)
+	}
+	var v [4]int
+	for i := range v {
+		// Limiting the values to 32 bits keeps their sums from overflowing.
+		n, err := strconv.ParseInt(m[i+1], 10, 32)
+		if err != nil {
+			return image.Rectangle{}, fmt.Errorf("invalid crop %q: %s", s, err)
+		}
+		v[i] = int(n)
+	}
+	return image.Rect(v[2], v[3], v[2]+v[0], v[3]+v[1]), nil
+}
+
+// processImage crops a png to the area, unless it's empty, clears its
+// background if -clear is set and then crops off the transparent margins.
+func processImage(file string, area image.Rectangle) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	src, err := png.Decode(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	b := src.Bounds()
+	if !area.Empty() {
+		b = area.Add(b.Min).Intersect(b)
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(img, img.Bounds(), src, b.Min, draw.Src)
+	if *clear {
+		clearBackground(img, uint8(math.Round(255*(1-*fuzz/100))))
+	}
+
+	trim := image.Rectangle{}
+	for y := 0; y < img.Rect.Dy(); y++ {
+		for x := 0; x < img.Rect.Dx(); x++ {
+			if img.Pix[img.PixOffset(x, y)+3] > 0 {
+				trim = trim.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	if trim.Empty() {
+		return fmt.Errorf("%s is blank", file)
+	}
+	f, err = os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img.SubImage(trim)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// clearBackground makes the pixels that are transparent or at least min in
+// every channel and connected to the edge of the image transparent, like a
+// flood fill from the corners.
+func clearBackground(img *image.NRGBA, min uint8) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	background := func(x, y int) bool {
+		p := img.Pix[img.PixOffset(x, y):]
+		return p[3] == 0 || p[0] >= min && p[1] >= min && p[2] >= min
+	}
+	var stack []image.Point
+	push := func(x, y int) {
+		if x < 0 || y < 0 || x >= w || y >= h || !background(x, y) {
+			return
+		}
+		// Cleared pixels are marked by being transparent black, so they're
+		// only visited once.
+		p := img.Pix[img.PixOffset(x, y):]
+		if p[3] == 0 && p[0] == 0 && p[1] == 0 && p[2] == 0 {
+			return
+		}
+		p[0], p[1], p[2], p[3] = 0, 0, 0, 0
+		stack = append(stack, image.Pt(x, y))
+	}
+	for x := 0; x < w; x++ {
+		push(x, 0)
+		push(x, h-1)
+	}
+	for y := 0; y < h; y++ {
+		push(0, y)
+		push(w-1, y)
+	}
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		push(p.X+1, p.Y)
+		push(p.X-1, p.Y)
+		push(p.X, p.Y+1)
+		push(p.X, p.Y-1)
+	}
+}
+
+// floorFile returns a file name for the floor's image.
+func floorFile(sis, floor, ext string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(floor))
+	return fmt.Sprintf("%s_floor%s.%s", strings.ToLower(sis), name, ext)
+}
+
+func ingest(pdf string) error {
+	if *format != "png" && *format != "svg" {
+		return fmt.Errorf("unsupported format %q", *format)
+	}
+	var area image.Rectangle
+	if len(*crop) > 0 {
+		var err error
+		if area, err = parseCrop(*crop); err != nil {
+			return err
+		}
+	}
+	// The rotation of existing floors is only changed if -rotate is given.
+	rotationSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "rotate" {
+			rotationSet = true
+		}
+	})
+
+	models.HistoryPath = *history
+	store, err := models.LoadStore()
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		// The snapshot can't be modified, so the changes are printed for a
+		// copy of the building.
+		b := store.Building(*sis)
+		if b == nil {
+			return fmt.Errorf("no building with SIS %q", *sis)
+		}
+		return addFloors(b.Clone(), pdf, area, rotationSet)
+	}
+	return store.Edit(*author, func(buildings []*models.Building) ([]string, error) {
+		for _, b := range buildings {
+			if b.SIS == *sis {
+				if err := addFloors(b, pdf, area, rotationSet); err != nil {
+					return nil, err
+				}
+				log.Printf("Saving floors of %s...", b.SIS)
+				return []string{b.SIS}, nil
+			}
+		}
+		return nil, fmt.Errorf("no building with SIS %q", *sis)
+	})
+}
+
+// addFloors adds or replaces the floors of the building with the pages of the
+// PDF, cropping png pages to the area unless it's empty. With -dryrun the
+// changes are only printed and no images are written.
+func addFloors(b *models.Building, pdf string, area image.Rectangle, rotationSet bool) error {
+	pages, err := pageCount(pdf)
+	if err != nil {
+		return err
+	}
+	var names []string
+	if len(*floors) > 0 {
+		names = strings.Split(*floors, ",")
+		if len(names) != pages {
+			return fmt.Errorf("%d floor names given for %d pages", len(names), pages)
+		}
+	} else {
+		for i := 1; i <= pages; i++ {
+			names = append(names, strconv.Itoa(i))
+		}
+	}
+
+	imageDir := *dir
+	if len(imageDir) == 0 {
+		imageDir = path.Join("maps", strings.ToLower(b.SIS))
+	}
+	if !*dryRun {
+		if err := os.MkdirAll(filepath.Join("static", imageDir), 0755); err != nil {
+			return err
+		}
+	}
+
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		img := path.Join(imageDir, floorFile(b.SIS, name, *format))
+		var floor *models.Floor
+		for _, f := range b.Floors {
+			if f.Name == name {
+				floor = f
+			}
+		}
+		if floor != nil {
+			fmt.Printf("%s: replacing image of floor %s with page %d: %s\n", b.SIS, name, i+1, img)
+		} else {
+			if b.Position == nil {
+				return fmt.Errorf("%s has no position to place floor %s at", b.SIS, name)
+			}
+			fmt.Printf("%s: adding floor %s from page %d: %s\n", b.SIS, name, i+1, img)
+			floor = &models.Floor{
+				Name: name,
+				Coords: &models.Coords{
+					North: b.Position.Lat + defaultLatSpan/2,
+					South: b.Position.Lat - defaultLatSpan/2,
+					East:  b.Position.Lng + defaultLngSpan/2,
+					West:  b.Position.Lng - defaultLngSpan/2,
+				},
+			}
+			b.Floors = append(b.Floors, floor)
+		}
+		floor.Image = img
+		if rotationSet {
+			floor.Rotation = *rotate * math.Pi / 180
+		}
+		if *dryRun {
+			continue
+		}
+		if err := extractPage(pdf, i+1, filepath.Join("static", img), area); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 || len(*sis) == 0 {
+		log.Fatal("usage: ingest_pdf -sis <SIS> [-floors B,1,2] [-format png|svg] [-rotate deg] [-crop WxH+X+Y] [-clear] [-dryrun] <file.pdf>\n" +
+			"requires pdfinfo and pdftocairo from poppler-utils")
+	}
+	if err := ingest(flag.Arg(0)); err != nil {
+		log.Fatal(err)
+	}
+}
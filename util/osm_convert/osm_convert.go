@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/d4l3k/campus/geojson"
+	"github.com/d4l3k/campus/models"
+	"github.com/d4l3k/campus/osm"
+)
+
+var (
+	importFile = flag.String("import", "", "the .osm file to seed new floors and rooms from")
+	exportFile = flag.String("export", "", "the .osm file to write rooms to")
+	dryRun     = flag.Bool("dryrun", false, "only print the changes an import would make")
+	author     = flag.String("author", "osm_convert", "the author to record the building revisions as")
+	history    = flag.String("history", "./history", "the directory to store building revisions in")
+)
+
+// importOSM adds the floors from the OSM extract that don't exist yet, along
+// with their rooms, as new revisions of the buildings.
+func importOSM(store *models.Store) error {
+	f, err := os.Open(*importFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	imported, err := osm.Read(f, store.Buildings())
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	for _, b := range store.Buildings() {
+		for _, f := range b.Floors {
+			existing[b.SIS+"/"+f.Name] = true
+		}
+	}
+	for _, b := range imported {
+		var floors []*models.Floor
+		for _, f := range b.Floors {
+			if existing[b.SIS+"/"+f.Name] {
+				log.Printf("Skipping existing floor %s %s", b.SIS, f.Name)
+				continue
+			}
+			floors = append(floors, f)
+		}
+		b.Floors = floors
+	}
+
+	fc := geojson.FromBuildings(imported, geojson.Filter{})
+	if *dryRun {
+		changes, err := geojson.Merge(store.Buildings(), fc, true)
+		if err != nil {
+			return err
+		}
+		for _, c := range changes {
+			fmt.Println(c)
+		}
+		return nil
+	}
+	return store.Edit(*author, func(buildings []*models.Building) ([]string, error) {
+		changes, err := geojson.Merge(buildings, fc, false)
+		if err != nil {
+			return nil, err
+		}
+		var changed []string
+		for _, c := range changes {
+			fmt.Println(c)
+			changed = append(changed, c.SIS)
+		}
+		log.Printf("Saving %d changes...", len(changes))
+		return changed, nil
+	})
+}
+
+func exportOSM(buildings []*models.Building) error {
+	f, err := os.Create(*exportFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return osm.Write(f, buildings)
+}
+
+func main() {
+	flag.Parse()
+	if len(*importFile) == 0 && len(*exportFile) == 0 {
+		log.Fatal("-import or -export is required")
+	}
+
+	models.HistoryPath = *history
+	store, err := models.LoadStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(*importFile) > 0 {
+		if err := importOSM(store); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(*exportFile) > 0 {
+		if err := exportOSM(store.Buildings()); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -18,6 +18,8 @@ var (
 	apiKey  = flag.String("key", "", "the google maps api key for geocoding")
 	scrape  = flag.Bool("scrape", false, "whether to scrape or not")
 	geocode = flag.Bool("geocode", false, "whether to geocode or not")
+	author  = flag.String("author", "scrape_wayfinding", "the author to record the building revisions as")
+	history = flag.String("history", "./history", "the directory to store building revisions in")
 
 	customSIS = map[string]string{
 		"Wayne and William White Engineering Design Centre": "EDC",
@@ -55,15 +57,14 @@ func fetchDetails(rel <-chan string, out chan *models.Building) {
 			SIS:         sis,
 			Image:       img,
 			Description: desc,
+			Occupants:   models.ParseOccupants(desc),
 		}
 	}
 }
 
-func scrapeBuildings() error {
-	buildings, err := models.LoadMapData()
-	if err != nil {
-		return err
-	}
+// scrapeBuildings updates the details of the existing buildings and adds the
+// buildings that don't exist yet.
+func scrapeBuildings(store *models.Store) error {
 	doc, err := goquery.NewDocument("http://www.maps.ubc.ca/PROD/buildingsListAll.php")
 	if err != nil {
 		return err
@@ -101,31 +102,49 @@ func scrapeBuildings() error {
 			break
 		}
 	}
-	buildingIndex := make(map[string]*models.Building)
-	for _, building := range buildings {
-		buildingIndex[building.SIS] = building
-	}
+	scraped := make(map[string]*models.Building)
 	for _, b := range scrapedBuildings {
-		if len(b.SIS) == 0 {
-			continue
+		if len(b.SIS) > 0 {
+			scraped[b.SIS] = b
 		}
-		if b2, ok := buildingIndex[b.SIS]; ok {
+	}
+	err = store.Edit(*author, func(buildings []*models.Building) ([]string, error) {
+		var changed []string
+		for _, b2 := range buildings {
+			b, ok := scraped[b2.SIS]
+			if !ok {
+				continue
+			}
+			delete(scraped, b2.SIS)
 			b2.Address = b.Address
 			b2.Image = b.Image
 			b2.Description = b.Description
-			continue
+			b2.Occupants = b.Occupants
+			changed = append(changed, b2.SIS)
 		}
-		buildingIndex[b.SIS] = b
-		buildings = append(buildings, b)
-	}
-	return models.SaveMapData(buildings)
-}
-
-func geocodeBuildings(c *maps.Client) error {
-	buildings, err := models.LoadMapData()
+		return changed, nil
+	})
 	if err != nil {
 		return err
 	}
+	for _, b := range scraped {
+		if _, err := store.Add(b, *author); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// geocodeBuildings looks up the positions of the buildings without one and
+// moves the buildings with floors to the center of their floors and rooms.
+func geocodeBuildings(c *maps.Client, store *models.Store) error {
+	return store.Edit(*author, func(buildings []*models.Building) ([]string, error) {
+		return geocodePositions(c, buildings)
+	})
+}
+
+func geocodePositions(c *maps.Client, buildings []*models.Building) ([]string, error) {
+	var changed []string
 	for _, b := range buildings {
 		if b.Position != nil || len(b.Address) == 0 {
 			continue
@@ -137,7 +156,7 @@ func geocodeBuildings(c *maps.Client) error {
 		}
 		result, err := c.Geocode(context.TODO(), req)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if len(result) == 0 {
 			continue
@@ -147,10 +166,8 @@ func geocodeBuildings(c *maps.Client) error {
 			Lat: loc.Lat,
 			Lng: loc.Lng,
 		}
+		changed = append(changed, b.SIS)
 		time.Sleep(100 * time.Millisecond)
-		if err := models.SaveMapData(buildings); err != nil {
-			return err
-		}
 	}
 	for _, b := range buildings {
 		if len(b.Floors) == 0 {
@@ -171,8 +188,9 @@ func geocodeBuildings(c *maps.Client) error {
 		}
 		b.Position.Lat = lat / c
 		b.Position.Lng = lng / c
+		changed = append(changed, b.SIS)
 	}
-	return models.SaveMapData(buildings)
+	return changed, nil
 }
 
 func main() {
@@ -185,13 +203,18 @@ func main() {
 		log.Fatalf("fatal error: %s", err)
 	}
 
+	models.HistoryPath = *history
+	store, err := models.LoadStore()
+	if err != nil {
+		log.Fatal(err)
+	}
 	if *scrape {
-		if err := scrapeBuildings(); err != nil {
+		if err := scrapeBuildings(store); err != nil {
 			log.Fatal(err)
 		}
 	}
 	if *geocode {
-		if err := geocodeBuildings(c); err != nil {
+		if err := geocodeBuildings(c, store); err != nil {
 			log.Fatal(err)
 		}
 	}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/d4l3k/campus/models"
+	"github.com/d4l3k/campus/mvt"
+	"github.com/gorilla/mux"
+)
+
+// vectorTiles returns a Mapbox Vector Tile with layers of the floor
+// footprints, rooms and buildings in the tile. The floor parameter limits the
+// floors and rooms to the floors with that name.
+func (s *Server) vectorTiles(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	z, err := strconv.Atoi(vars["z"])
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	x, err := strconv.Atoi(vars["x"])
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	y, err := strconv.Atoi(vars["y"])
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := checkTile(z, x, y); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	floorName := r.URL.Query().Get("floor")
+
+	point := tileToPoint(x, y, z)
+	pointBottom := tileToPoint(x+1, y+1, z)
+	coords := &models.Coords{
+		North: point.Lat(),
+		South: pointBottom.Lat(),
+		West:  point.Lng(),
+		East:  pointBottom.Lng(),
+	}
+	project := func(p *models.LatLng) mvt.Point {
+		px, py := pointToTileFraction(p.Lat, p.Lng, z)
+		return mvt.Point{
+			X: int(math.Floor((px-float64(x))*mvt.DefaultExtent + 0.5)),
+			Y: int(math.Floor((py-float64(y))*mvt.DefaultExtent + 0.5)),
+		}
+	}
+
+	floors := &mvt.Layer{Name: "floors"}
+	rooms := &mvt.Layer{Name: "rooms"}
+	buildings := &mvt.Layer{Name: "buildings"}
+	for _, b := range s.OverlappingBuildings(coords) {
+		if b.Position != nil && coords.OverlapLatLng(b.Position) {
+			buildings.Features = append(buildings.Features, &mvt.Feature{
+				Type:     mvt.PointGeom,
+				Geometry: [][]mvt.Point{{project(b.Position)}},
+				Properties: map[string]interface{}{
+					"sis":  b.SIS,
+					"name": b.Name,
+				},
+			})
+		}
+		for _, f := range b.Floors {
+			if len(floorName) > 0 && f.Name != floorName {
+				continue
+			}
+			if f.Coords != nil && coords.Overlap(f.Coords) {
+				var ring []mvt.Point
+				for _, p := range f.Footprint() {
+					ring = append(ring, project(p))
+				}
+				floors.Features = append(floors.Features, &mvt.Feature{
+					Type:     mvt.Polygon,
+					Geometry: [][]mvt.Point{ring},
+					Properties: map[string]interface{}{
+						"sis":   b.SIS,
+						"floor": f.Name,
+					},
+				})
+			}
+			for _, room := range f.Rooms {
+				if room.Position == nil || !coords.OverlapLatLng(room.Position) {
+					continue
+				}
+				rooms.Features = append(rooms.Features, &mvt.Feature{
+					Type:     mvt.PointGeom,
+					Geometry: [][]mvt.Point{{project(room.Position)}},
+					Properties: map[string]interface{}{
+						"id":    room.Id,
+						"name":  room.Name,
+						"type":  room.Type,
+						"sis":   b.SIS,
+						"floor": f.Name,
+					},
+				})
+			}
+		}
+	}
+
+	tile := &mvt.Tile{Layers: []*mvt.Layer{floors, rooms, buildings}}
+	buf, err := tile.Marshal()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	w.Write(buf)
+}
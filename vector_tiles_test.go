@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/d4l3k/campus/mvt"
+	"github.com/gorilla/mux"
+)
+
+// vectorTile requests a vector tile from testServer.
+func vectorTile(t *testing.T, z, x, y int, floor string) (*httptest.ResponseRecorder, *mvt.Tile) {
+	vars := map[string]string{"z": strconv.Itoa(z), "x": strconv.Itoa(x), "y": strconv.Itoa(y)}
+	r := mux.SetURLVars(httptest.NewRequest("GET", "/api/vtiles/?floor="+floor, nil), vars)
+	w := httptest.NewRecorder()
+	testServer.vectorTiles(w, r)
+	if w.Code != 200 {
+		return w, nil
+	}
+	tile, err := mvt.Unmarshal(w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, tile
+}
+
+func TestVectorTiles(t *testing.T) {
+	iccs := testServer.store.Building("ICCS")
+	z := 17
+	x, y := pointToTile(iccs.Position.Lat, iccs.Position.Lng, z)
+	w, tile := vectorTile(t, z, x, y, "")
+	if tile == nil {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/vnd.mapbox-vector-tile" {
+		t.Errorf("got content type %q", ct)
+	}
+
+	layers := make(map[string]*mvt.Layer)
+	for _, l := range tile.Layers {
+		layers[l.Name] = l
+	}
+	// has returns whether the layer has a feature in ICCS with the property.
+	has := func(layer, key, value string) bool {
+		l := layers[layer]
+		if l == nil {
+			return false
+		}
+		for _, f := range l.Features {
+			if f.Properties["sis"] == "ICCS" && f.Properties[key] == value {
+				return true
+			}
+		}
+		return false
+	}
+	if !has("buildings", "name", iccs.Name) {
+		t.Errorf("buildings layer is missing ICCS")
+	}
+	for _, f := range iccs.Floors {
+		if f.Coords != nil && !has("floors", "floor", f.Name) {
+			t.Errorf("floors layer is missing ICCS floor %s", f.Name)
+		}
+	}
+	if !has("rooms", "id", "X150") {
+		t.Errorf("rooms layer is missing ICCS X150")
+	}
+	for _, l := range tile.Layers {
+		if l.Extent != mvt.DefaultExtent {
+			t.Errorf("layer %s: got extent %d", l.Name, l.Extent)
+		}
+		for _, f := range l.Features {
+			if l.Name == "floors" && f.Type != mvt.Polygon || l.Name != "floors" && f.Type != mvt.PointGeom {
+				t.Errorf("layer %s: got geometry type %d", l.Name, f.Type)
+			}
+		}
+	}
+
+	// Only the requested floor is included.
+	_, tile = vectorTile(t, z, x, y, "2")
+	for _, l := range tile.Layers {
+		for _, f := range l.Features {
+			if floor, ok := f.Properties["floor"]; ok && floor != "2" {
+				t.Errorf("layer %s: got floor %v, want only floor 2", l.Name, floor)
+			}
+		}
+	}
+
+	for _, tile := range [][3]int{{23, 0, 0}, {2, 4, 0}} {
+		if w, _ := vectorTile(t, tile[0], tile[1], tile[2], ""); w.Code != 400 {
+			t.Errorf("tile %v: got status %d, want 400", tile, w.Code)
+		}
+	}
+}